@@ -2,6 +2,7 @@ package ast
 
 import (
 	"bytes"
+	"fmt"
 	"strings"
 
 	"lookageek.com/ode/token"
@@ -10,9 +11,11 @@ import (
 // AST structure holds the two basic types of code lines, statements & expressions
 // statements do not evaluate and present back a value, expressions do
 
-// Node is the basic node of the AST which can hold a token
+// Node is the basic node of the AST which can hold a token,
+// Pos is where the token of the node starts in the source
 type Node interface {
 	TokenLiteral() string
+	Pos() token.Position
 	String() string
 }
 
@@ -43,6 +46,14 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Pos() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+
+	return token.Position{}
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 
@@ -63,6 +74,7 @@ type Identifier struct {
 // places the identifier DOES produce a value like `let x = valueProducingIdentifier;`
 func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
+func (i *Identifier) Pos() token.Position  { return i.Token.Position }
 
 func (i *Identifier) String() string {
 	return i.Value
@@ -81,6 +93,7 @@ func (ls *LetStatement) statementNode() {}
 func (ls *LetStatement) TokenLiteral() string {
 	return ls.Token.Literal
 }
+func (ls *LetStatement) Pos() token.Position { return ls.Token.Position }
 
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
@@ -109,6 +122,7 @@ func (rs *ReturnStatement) statementNode() {}
 func (rs *ReturnStatement) TokenLiteral() string {
 	return rs.Token.Literal
 }
+func (rs *ReturnStatement) Pos() token.Position { return rs.Token.Position }
 
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
@@ -137,6 +151,7 @@ func (es *ExpressionStatement) statementNode() {}
 func (es *ExpressionStatement) TokenLiteral() string {
 	return es.Token.Literal
 }
+func (es *ExpressionStatement) Pos() token.Position { return es.Token.Position }
 
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
@@ -157,6 +172,7 @@ func (il *IntegerLiteral) expressionNode() {}
 func (il *IntegerLiteral) TokenLiteral() string {
 	return il.Token.Literal
 }
+func (il *IntegerLiteral) Pos() token.Position { return il.Token.Position }
 
 func (il *IntegerLiteral) String() string {
 	return il.Token.Literal
@@ -174,6 +190,7 @@ func (pe *PrefixExpression) expressionNode() {}
 func (pe *PrefixExpression) TokenLiteral() string {
 	return pe.Token.Literal
 }
+func (pe *PrefixExpression) Pos() token.Position { return pe.Token.Position }
 
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
@@ -199,6 +216,7 @@ func (e *InfixExpression) expressionNode() {}
 func (e *InfixExpression) TokenLiteral() string {
 	return e.Token.Literal
 }
+func (e *InfixExpression) Pos() token.Position { return e.Token.Position }
 
 func (e *InfixExpression) String() string {
 	var out bytes.Buffer
@@ -220,6 +238,7 @@ type Boolean struct {
 
 func (b *Boolean) expressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
+func (b *Boolean) Pos() token.Position  { return b.Token.Position }
 func (b *Boolean) String() string       { return b.Token.Literal }
 
 // IfExpression node holds the entire if expression with else block
@@ -234,6 +253,7 @@ func (ie *IfExpression) expressionNode() {}
 func (ie *IfExpression) TokenLiteral() string {
 	return ie.Token.Literal
 }
+func (ie *IfExpression) Pos() token.Position { return ie.Token.Position }
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
 
@@ -261,6 +281,7 @@ func (bs *BlockStatement) statementNode() {}
 func (bs *BlockStatement) TokenLiteral() string {
 	return bs.Token.Literal
 }
+func (bs *BlockStatement) Pos() token.Position { return bs.Token.Position }
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 
@@ -277,10 +298,14 @@ type FunctionLiteral struct {
 	Token      token.Token
 	Parameters []*Identifier
 	Body       *BlockStatement
+	// Name is set when the function literal is bound with a let statement,
+	// the compiler uses it to let a function refer to itself recursively
+	Name string
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
 func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FunctionLiteral) Pos() token.Position  { return fl.Token.Position }
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
@@ -290,6 +315,9 @@ func (fl *FunctionLiteral) String() string {
 	}
 
 	out.WriteString(fl.TokenLiteral())
+	if fl.Name != "" {
+		out.WriteString(fmt.Sprintf("<%s>", fl.Name))
+	}
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(") ")
@@ -306,10 +334,15 @@ type CallExpression struct {
 	// literal as is fn(x, y) { x + y }(2, 3);
 	Function  Expression
 	Arguments []Expression
+	// Tail is set by the parser for a call in tail position of a function body, the
+	// value of the call is returned as the value of the function. A tail call does not
+	// need the frame of the function any more so the engines reuse it
+	Tail bool
 }
 
 func (ce *CallExpression) expressionNode()      {}
 func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() token.Position  { return ce.Token.Position }
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer
 
@@ -337,6 +370,7 @@ type StringLiteral struct {
 
 func (sl *StringLiteral) expressionNode()      {}
 func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() token.Position  { return sl.Token.Position }
 func (sl *StringLiteral) String() string       { return sl.Token.Literal }
 
 // ArrayLiteral holds the array which can have any kind of object
@@ -350,6 +384,7 @@ func (al *ArrayLiteral) expressionNode() {}
 func (al *ArrayLiteral) TokenLiteral() string {
 	return al.Token.Literal
 }
+func (al *ArrayLiteral) Pos() token.Position { return al.Token.Position }
 func (al *ArrayLiteral) String() string {
 	var out bytes.Buffer
 
@@ -378,6 +413,7 @@ func (ie *IndexExpression) expressionNode() {}
 func (ie *IndexExpression) TokenLiteral() string {
 	return ie.Token.Literal
 }
+func (ie *IndexExpression) Pos() token.Position { return ie.Token.Position }
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
 
@@ -400,6 +436,7 @@ func (hl *HashLiteral) expressionNode() {}
 func (hl *HashLiteral) TokenLiteral() string {
 	return hl.Token.Literal
 }
+func (hl *HashLiteral) Pos() token.Position { return hl.Token.Position }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 
@@ -0,0 +1,92 @@
+// Package budget limits how long the evaluator and the VM may run, so that hosts can
+// run untrusted programs. A budget counts the steps of an execution, the instructions
+// of the VM or the evaluated nodes of the evaluator, checks the call depth against a
+// limit and stops the execution when its context is done or its time is up
+package budget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// checkInterval is the number of steps between two checks of the context and the
+// clock, checking them at every step would slow down the execution noticeably
+const checkInterval = 1024
+
+// the errors of the exceeded limits, the engines return errors wrapping them
+var (
+	ErrSteps = errors.New("step limit exceeded")
+	ErrDepth = errors.New("call depth limit exceeded")
+	ErrTime  = errors.New("time limit exceeded")
+)
+
+// Limits are the limits of an execution, a zero limit is no limit
+type Limits struct {
+	// Steps is the maximum number of steps
+	Steps int64
+	// Depth is the maximum number of nested calls
+	Depth int
+	// Time is the maximum wall time
+	Time time.Duration
+}
+
+// Budget is what is left of the limits of a running execution
+type Budget struct {
+	ctx    context.Context
+	limits Limits
+
+	steps    int64
+	deadline time.Time
+}
+
+// New starts the budget of an execution, which is stopped early when ctx is done
+func New(ctx context.Context, limits Limits) *Budget {
+	b := &Budget{ctx: ctx, limits: limits}
+	if limits.Time > 0 {
+		b.deadline = time.Now().Add(limits.Time)
+	}
+
+	return b
+}
+
+// Step counts a step, it fails when the steps are used up, the time is up or
+// the context is done. The time and the context are checked every few steps
+func (b *Budget) Step() error {
+	b.steps++
+
+	if b.limits.Steps > 0 && b.steps > b.limits.Steps {
+		return fmt.Errorf("%w after %d steps", ErrSteps, b.limits.Steps)
+	}
+
+	// the first step is checked as well so that nothing runs once the context is done
+	if b.steps%checkInterval == 1 {
+		return b.Check()
+	}
+
+	return nil
+}
+
+// Check fails when the time is up or the context is done, without counting a step
+func (b *Budget) Check() error {
+	if !b.deadline.IsZero() && time.Now().After(b.deadline) {
+		return fmt.Errorf("%w after %s", ErrTime, b.limits.Time)
+	}
+
+	return b.ctx.Err()
+}
+
+// Call fails when a call to the given depth is too deep
+func (b *Budget) Call(depth int) error {
+	if b.limits.Depth > 0 && depth > b.limits.Depth {
+		return fmt.Errorf("%w: more than %d nested calls", ErrDepth, b.limits.Depth)
+	}
+
+	return nil
+}
+
+// Steps is the number of steps counted so far
+func (b *Budget) Steps() int64 {
+	return b.steps
+}
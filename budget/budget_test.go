@@ -0,0 +1,89 @@
+package budget
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSteps(t *testing.T) {
+	b := New(context.Background(), Limits{Steps: 3})
+
+	for i := 0; i < 3; i++ {
+		err := b.Step()
+		if err != nil {
+			t.Fatalf("step %d failed: %s", i+1, err)
+		}
+	}
+
+	err := b.Step()
+	if !errors.Is(err, ErrSteps) {
+		t.Fatalf("wrong error. want = %s, got = %v", ErrSteps, err)
+	}
+	if err.Error() != "step limit exceeded after 3 steps" {
+		t.Errorf("wrong message. got = %q", err)
+	}
+}
+
+func TestDepth(t *testing.T) {
+	b := New(context.Background(), Limits{Depth: 2})
+
+	if err := b.Call(2); err != nil {
+		t.Fatalf("call at the limit failed: %s", err)
+	}
+
+	err := b.Call(3)
+	if !errors.Is(err, ErrDepth) {
+		t.Fatalf("wrong error. want = %s, got = %v", ErrDepth, err)
+	}
+	if err.Error() != "call depth limit exceeded: more than 2 nested calls" {
+		t.Errorf("wrong message. got = %q", err)
+	}
+}
+
+func TestTime(t *testing.T) {
+	b := New(context.Background(), Limits{Time: time.Millisecond})
+	time.Sleep(2 * time.Millisecond)
+
+	// the clock is only looked at every checkInterval steps
+	var err error
+	for i := 0; i < checkInterval && err == nil; i++ {
+		err = b.Step()
+	}
+
+	if !errors.Is(err, ErrTime) {
+		t.Fatalf("wrong error. want = %s, got = %v", ErrTime, err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// a done context stops the execution at its first step
+	b := New(ctx, Limits{})
+	err := b.Step()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error. want = %s, got = %v", context.Canceled, err)
+	}
+
+	if b.Steps() != 1 {
+		t.Errorf("wrong steps. want = 1, got = %d", b.Steps())
+	}
+}
+
+func TestNoLimits(t *testing.T) {
+	b := New(context.Background(), Limits{})
+
+	for i := 0; i < 10*checkInterval; i++ {
+		err := b.Step()
+		if err != nil {
+			t.Fatalf("step %d failed: %s", i+1, err)
+		}
+	}
+
+	if err := b.Call(1 << 20); err != nil {
+		t.Errorf("deep call failed: %s", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 )
 
 // Instructions will be the byte array representation of the byte code
@@ -19,10 +20,17 @@ func (ins Instructions) String() string {
 	for offset < len(ins) {
 		def, err := Lookup(ins[offset])
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			// skip the undefined byte, the following bytes are printed as if they were instructions
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", offset, err)
+			offset++
 			continue
 		}
 
+		if offset+1+def.operandsWidth() > len(ins) {
+			fmt.Fprintf(&out, "%04d ERROR: %s truncated\n", offset, def.Name)
+			break
+		}
+
 		operands, read := ReadOperands(def, ins[offset+1:])
 
 		fmt.Fprintf(&out, "%04d %s\n", offset, ins.fmtInstruction(def, operands))
@@ -41,14 +49,12 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 		return fmt.Sprintf("ERROR: operand len %d does not match defined %d\n", len(operands), operandCount)
 	}
 
-	switch operandCount {
-	case 0:
-		return def.Name
-	case 1:
-		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	out := def.Name
+	for _, operand := range operands {
+		out += fmt.Sprintf(" %d", operand)
 	}
 
-	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
+	return out
 }
 
 // Opcode is a single byte operation code in the instruction referencing
@@ -58,6 +64,67 @@ type Opcode byte
 const (
 	OpConstant Opcode = iota
 	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpEqual
+	OpNotEqual
+	OpGreaterThan
+	// OpPop pops the topmost element off the stack, emitted after every
+	// expression statement so the stack does not keep growing
+	OpPop
+	OpTrue
+	OpFalse
+	OpMinus
+	OpBang
+	// OpJumpNotTruthy and OpJump take an absolute offset into the instructions as operand,
+	// OpJumpNotTruthy only jumps when the popped condition is not truthy
+	OpJumpNotTruthy
+	OpJump
+	OpNull
+	// OpSetGlobal and OpGetGlobal operand is the index of the global binding
+	OpSetGlobal
+	OpGetGlobal
+	// OpArray operand is the number of elements on the stack which make up the array
+	OpArray
+	// OpHash operand is the number of keys and values on the stack, twice the number of pairs
+	OpHash
+	OpIndex
+	// OpCall operand is the number of arguments pushed after the called function
+	OpCall
+	// OpReturnValue returns the value on top of the stack, OpReturn returns null
+	OpReturnValue
+	OpReturn
+	// OpSetLocal and OpGetLocal operand is the index of the local binding in the current frame
+	OpSetLocal
+	OpGetLocal
+	// OpGetBuiltin operand is the index of the builtin in object.Builtins
+	OpGetBuiltin
+	// OpClosure operands are the constant index of the compiled function and the
+	// number of free variables on the stack which the closure captures
+	OpClosure
+	// OpGetFree operand is the index into the free variables of the current closure
+	OpGetFree
+	// OpCurrentClosure pushes the closure being executed, used for recursive calls
+	OpCurrentClosure
+	// OpAddConstant and OpSubConstant are superinstructions emitted by Optimize, an
+	// OpConstant fused with the following OpAdd or OpSub. The operand is the constant
+	// index, the constant is the right operand and the top of the stack the left one
+	OpAddConstant
+	OpSubConstant
+	// OpConstantWide is OpConstant with a 4 byte operand, emitted for the
+	// constants whose index does not fit into the 2 byte operand of OpConstant
+	OpConstantWide
+	// OpTailCall is OpCall for a call in tail position, emitted in place of OpCall
+	// when the call's value is returned. Calling a closure replaces the frame of the
+	// current function, calling a builtin continues with the next instruction
+	OpTailCall
+	// OpLessThan compares like OpGreaterThan with the operands the other way around,
+	// "<" compiles to it so its operands are evaluated in source order
+	OpLessThan
+	// OpClosureWide is OpClosure with a 4 byte constant index, emitted for the
+	// functions whose index does not fit into the 2 byte operand of OpClosure
+	OpClosureWide
 )
 
 // Definition is a handy debugging view of the opcode and
@@ -68,8 +135,52 @@ type Definition struct {
 }
 
 var definitions = map[Opcode]*Definition{
-	OpConstant: {"OpConstant", []int{2}},
-	OpAdd: {"OpAdd", []int{}},
+	OpConstant:       {"OpConstant", []int{2}},
+	OpAdd:            {"OpAdd", []int{}},
+	OpSub:            {"OpSub", []int{}},
+	OpMul:            {"OpMul", []int{}},
+	OpDiv:            {"OpDiv", []int{}},
+	OpEqual:          {"OpEqual", []int{}},
+	OpNotEqual:       {"OpNotEqual", []int{}},
+	OpGreaterThan:    {"OpGreaterThan", []int{}},
+	OpPop:            {"OpPop", []int{}},
+	OpTrue:           {"OpTrue", []int{}},
+	OpFalse:          {"OpFalse", []int{}},
+	OpMinus:          {"OpMinus", []int{}},
+	OpBang:           {"OpBang", []int{}},
+	OpJumpNotTruthy:  {"OpJumpNotTruthy", []int{2}},
+	OpJump:           {"OpJump", []int{2}},
+	OpNull:           {"OpNull", []int{}},
+	OpSetGlobal:      {"OpSetGlobal", []int{2}},
+	OpGetGlobal:      {"OpGetGlobal", []int{2}},
+	OpArray:          {"OpArray", []int{2}},
+	OpHash:           {"OpHash", []int{2}},
+	OpIndex:          {"OpIndex", []int{}},
+	OpCall:           {"OpCall", []int{1}},
+	OpReturnValue:    {"OpReturnValue", []int{}},
+	OpReturn:         {"OpReturn", []int{}},
+	OpSetLocal:       {"OpSetLocal", []int{1}},
+	OpGetLocal:       {"OpGetLocal", []int{1}},
+	OpGetBuiltin:     {"OpGetBuiltin", []int{1}},
+	OpClosure:        {"OpClosure", []int{2, 1}},
+	OpGetFree:        {"OpGetFree", []int{1}},
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpAddConstant:    {"OpAddConstant", []int{2}},
+	OpSubConstant:    {"OpSubConstant", []int{2}},
+	OpConstantWide:   {"OpConstantWide", []int{4}},
+	OpTailCall:       {"OpTailCall", []int{1}},
+	OpLessThan:       {"OpLessThan", []int{}},
+	OpClosureWide:    {"OpClosureWide", []int{4, 1}},
+}
+
+// operandsWidth is the number of bytes all the operands of the opcode occupy
+func (def *Definition) operandsWidth() int {
+	width := 0
+	for _, operandWidth := range def.OperandWidths {
+		width += operandWidth
+	}
+
+	return width
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -81,8 +192,48 @@ func Lookup(op byte) (*Definition, error) {
 	return def, nil
 }
 
+// Fingerprint is a checksum over the names and operand widths of all opcodes in
+// opcode order, bytecode written with another opcode set has a different fingerprint
+func Fingerprint() uint32 {
+	hash := crc32.NewIEEE()
+
+	for op := 0; op < 256; op++ {
+		def, ok := definitions[Opcode(op)]
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(hash, "%d %s %v;", op, def.Name, def.OperandWidths)
+	}
+
+	return hash.Sum32()
+}
+
+// CheckOperands reports operands which Make can not encode, because they are
+// negative or too large for their width and would be silently truncated
+func CheckOperands(op Opcode, operands ...int) error {
+	def, ok := definitions[op]
+	if !ok {
+		return fmt.Errorf("opcode %d undefined", op)
+	}
+
+	if len(operands) != len(def.OperandWidths) {
+		return fmt.Errorf("%s takes %d operands, got %d", def.Name, len(def.OperandWidths), len(operands))
+	}
+
+	for i, operand := range operands {
+		width := def.OperandWidths[i]
+		if operand < 0 || uint64(operand) >= 1<<(8*uint(width)) {
+			return fmt.Errorf("%s operand %d does not fit into %d bytes", def.Name, operand, width)
+		}
+	}
+
+	return nil
+}
+
 // Make will take opcode and operands of an instruction,
-// create the bytecode binary representation of that instruction
+// create the bytecode binary representation of that instruction. Operands too
+// large for their width are truncated, see CheckOperands
 func Make(op Opcode, operands ...int) []byte {
 	def, ok := definitions[op]
 	if !ok {
@@ -93,10 +244,7 @@ func Make(op Opcode, operands ...int) []byte {
 	// bytes all the operands will occupy for that opcode
 	// we need the total instructionLen to construct the requisite sized
 	// byte array for the instruction
-	instructionLen := 1
-	for _, operandWidth := range def.OperandWidths {
-		instructionLen += operandWidth
-	}
+	instructionLen := 1 + def.operandsWidth()
 
 	instruction := make([]byte, instructionLen)
 	instruction[0] = byte(op)
@@ -105,8 +253,12 @@ func Make(op Opcode, operands ...int) []byte {
 	for i, operand := range operands {
 		operandWidth := def.OperandWidths[i]
 		switch operandWidth {
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(operand))
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(operand))
+		case 1:
+			instruction[offset] = byte(operand)
 		}
 
 		offset += operandWidth
@@ -123,11 +275,15 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 
 	// for each of the operands, query the Definition for its width
 	// then increment the total number of bytes read
-	// the operands (2 byte long) are stored in big-endian so decode into integer of 16bits
+	// the operands (1, 2 or 4 bytes long) are stored in big-endian
 	for i, operandWidth := range def.OperandWidths {
 		switch operandWidth {
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		case 2:
 			operands[i] = int(ReadUInt16(ins[offset:]))
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
 		}
 
 		offset += operandWidth
@@ -136,6 +292,14 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	return operands, offset
 }
 
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 func ReadUInt16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
+
+func ReadUint8(ins Instructions) uint8 {
+	return uint8(ins[0])
+}
@@ -11,6 +11,11 @@ func TestMake(t *testing.T) {
 		// big-ending encoding of 65534 into 2 bytes produces 255 and 254 bytes, in that order
 		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
 		{OpAdd, []int{}, []byte{byte(OpAdd)}},
+		{OpPop, []int{}, []byte{byte(OpPop)}},
+		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
+		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpConstantWide, []int{65536}, []byte{byte(OpConstantWide), 0, 1, 0, 0}},
+		{OpClosureWide, []int{65536, 2}, []byte{byte(OpClosureWide), 0, 1, 0, 0, 2}},
 	}
 
 	for _, tt := range tests {
@@ -34,11 +39,17 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpAdd),
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
+		Make(OpGreaterThan),
+		Make(OpGetLocal, 1),
+		Make(OpClosure, 65535, 255),
 	}
 
 	expected := `0000 OpAdd
 0001 OpConstant 2
 0004 OpConstant 65535
+0007 OpGreaterThan
+0008 OpGetLocal 1
+0010 OpClosure 65535 255
 `
 
 	concatted := Instructions{}
@@ -58,6 +69,10 @@ func TestReadOperands(t *testing.T) {
 		bytesRead int
 	}{
 		{OpConstant, []int{65535}, 2},
+		{OpGetLocal, []int{255}, 1},
+		{OpClosure, []int{65535, 255}, 3},
+		{OpConstantWide, []int{4294967295}, 4},
+		{OpClosureWide, []int{4294967295, 255}, 5},
 	}
 
 	for _, tt := range tests {
@@ -80,3 +95,48 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestInstructionsStringReportsBadInstructions(t *testing.T) {
+	instructions := Instructions{byte(OpPop), 255, byte(OpAdd)}
+	instructions = append(instructions, Make(OpConstant, 1)[:2]...)
+
+	expected := `0000 OpPop
+0001 ERROR: opcode 255 undefined
+0002 OpAdd
+0003 ERROR: OpConstant truncated
+`
+
+	if instructions.String() != expected {
+		t.Errorf("instructions wrongly formatted.\nwant = %q\ngot = %q", expected, instructions.String())
+	}
+}
+
+func TestCheckOperands(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected string
+	}{
+		{OpConstant, []int{65535}, ""},
+		{OpConstant, []int{65536}, "OpConstant operand 65536 does not fit into 2 bytes"},
+		{OpConstant, []int{-1}, "OpConstant operand -1 does not fit into 2 bytes"},
+		{OpGetLocal, []int{256}, "OpGetLocal operand 256 does not fit into 1 bytes"},
+		{OpClosure, []int{1, 256}, "OpClosure operand 256 does not fit into 1 bytes"},
+		{OpConstantWide, []int{65536}, ""},
+		{OpAdd, []int{1}, "OpAdd takes 0 operands, got 1"},
+		{Opcode(255), []int{}, "opcode 255 undefined"},
+	}
+
+	for _, tt := range tests {
+		err := CheckOperands(tt.op, tt.operands...)
+
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+
+		if got != tt.expected {
+			t.Errorf("wrong error for %d %v. want = %q, got = %q", tt.op, tt.operands, tt.expected, got)
+		}
+	}
+}
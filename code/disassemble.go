@@ -0,0 +1,204 @@
+package code
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Constant is what Disassemble needs to know about an entry of the constant pool
+type Constant struct {
+	// Value is the inspected value, shown next to the instructions referencing the constant
+	Value string
+	// Instructions are set when the constant is a compiled function
+	Instructions Instructions
+}
+
+// decoded is a single instruction decoded by decode
+type decoded struct {
+	offset   int
+	op       Opcode
+	def      *Definition
+	operands []int
+}
+
+// Disassemble prints the main instructions followed by the instructions of every compiled
+// function in the constant pool. Jump targets are labelled and the jumps refer to
+// the labels, constants are annotated with their value. An error is returned for
+// undefined opcodes and truncated instructions, together with the listing up to them,
+// and for jumps to offsets where no instruction starts, which the listing marks invalid
+func Disassemble(main Instructions, constants []Constant) (string, error) {
+	var out bytes.Buffer
+
+	fmt.Fprintf(&out, "== main ==\n")
+	err := disassembleFunction(&out, main, constants)
+	if err != nil {
+		return out.String(), fmt.Errorf("main: %s", err)
+	}
+
+	for i, constant := range constants {
+		if constant.Instructions == nil {
+			continue
+		}
+
+		fmt.Fprintf(&out, "\n== constant %d: %s ==\n", i, constant.Value)
+		err := disassembleFunction(&out, constant.Instructions, constants)
+		if err != nil {
+			return out.String(), fmt.Errorf("constant %d: %s", i, err)
+		}
+	}
+
+	return out.String(), nil
+}
+
+// DisassembleInstruction formats the single instruction at offset like Disassemble
+// does, except that a jump refers to the offset of its target instead of a label
+func DisassembleInstruction(ins Instructions, offset int, constants []Constant) (string, error) {
+	if offset < 0 || offset >= len(ins) {
+		return "", fmt.Errorf("offset %04d out of range", offset)
+	}
+
+	in, err := decodeAt(ins, offset)
+	if err != nil {
+		return "", err
+	}
+
+	labels := map[int]string{}
+	if isJump(in.op) {
+		labels[in.operands[0]] = fmt.Sprintf("%04d", in.operands[0])
+	}
+
+	return fmt.Sprintf("%04d %s", offset, formatInstruction(in, labels, constants)), nil
+}
+
+func disassembleFunction(out *bytes.Buffer, ins Instructions, constants []Constant) error {
+	instructions, err := decode(ins)
+
+	labels := jumpLabels(instructions, len(ins))
+
+	for _, in := range instructions {
+		if label, ok := labels[in.offset]; ok {
+			fmt.Fprintf(out, "%s:\n", label)
+		}
+
+		fmt.Fprintf(out, "    %04d %s\n", in.offset, formatInstruction(in, labels, constants))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// a jump past the last instruction ends the function
+	if label, ok := labels[len(ins)]; ok {
+		fmt.Fprintf(out, "%s:\n", label)
+	}
+
+	for _, in := range instructions {
+		if !isJump(in.op) {
+			continue
+		}
+
+		target := in.operands[0]
+		if target > len(ins) {
+			return fmt.Errorf("jump target %04d out of range", target)
+		}
+		if _, ok := labels[target]; !ok {
+			return fmt.Errorf("jump target %04d is not the start of an instruction", target)
+		}
+	}
+
+	return nil
+}
+
+// decode decodes the instructions up to the first undefined opcode or truncated instruction
+func decode(ins Instructions) ([]decoded, error) {
+	instructions := []decoded{}
+
+	offset := 0
+	for offset < len(ins) {
+		in, err := decodeAt(ins, offset)
+		if err != nil {
+			return instructions, err
+		}
+
+		instructions = append(instructions, in)
+		offset += 1 + in.def.operandsWidth()
+	}
+
+	return instructions, nil
+}
+
+// decodeAt decodes the single instruction starting at offset
+func decodeAt(ins Instructions, offset int) (decoded, error) {
+	def, err := Lookup(ins[offset])
+	if err != nil {
+		return decoded{}, fmt.Errorf("offset %04d: %s", offset, err)
+	}
+
+	if offset+1+def.operandsWidth() > len(ins) {
+		return decoded{}, fmt.Errorf("offset %04d: %s truncated", offset, def.Name)
+	}
+
+	operands, _ := ReadOperands(def, ins[offset+1:])
+	return decoded{offset, Opcode(ins[offset]), def, operands}, nil
+}
+
+// jumpLabels names the targets of all the jumps L1, L2, ... in the order of their offsets.
+// Only the starts of the instructions and the end of the function are valid targets,
+// the jumps to any other offset get no label
+func jumpLabels(instructions []decoded, length int) map[int]string {
+	starts := map[int]bool{length: true}
+	for _, in := range instructions {
+		starts[in.offset] = true
+	}
+
+	targets := []int{}
+	seen := make(map[int]bool)
+
+	for _, in := range instructions {
+		if !isJump(in.op) || seen[in.operands[0]] || !starts[in.operands[0]] {
+			continue
+		}
+
+		seen[in.operands[0]] = true
+		targets = append(targets, in.operands[0])
+	}
+
+	sort.Ints(targets)
+
+	labels := make(map[int]string)
+	for i, target := range targets {
+		labels[target] = fmt.Sprintf("L%d", i+1)
+	}
+
+	return labels
+}
+
+func isJump(op Opcode) bool {
+	return op == OpJump || op == OpJumpNotTruthy
+}
+
+func formatInstruction(in decoded, labels map[int]string, constants []Constant) string {
+	if isJump(in.op) {
+		label, ok := labels[in.operands[0]]
+		if !ok {
+			return fmt.Sprintf("%-24s ; invalid jump target", fmt.Sprintf("%s %04d", in.def.Name, in.operands[0]))
+		}
+
+		return fmt.Sprintf("%s %s", in.def.Name, label)
+	}
+
+	text := Instructions{}.fmtInstruction(in.def, in.operands)
+
+	switch in.op {
+	case OpConstant, OpConstantWide, OpClosure, OpClosureWide, OpAddConstant, OpSubConstant:
+		index := in.operands[0]
+		if index >= len(constants) {
+			return fmt.Sprintf("%-24s ; constant out of range", text)
+		}
+
+		return fmt.Sprintf("%-24s ; %s", text, constants[index].Value)
+	default:
+		return text
+	}
+}
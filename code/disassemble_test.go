@@ -0,0 +1,179 @@
+package code
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	main := concat(
+		Make(OpTrue),
+		Make(OpJumpNotTruthy, 10),
+		Make(OpConstant, 0),
+		Make(OpJump, 15),
+		Make(OpClosure, 1, 0),
+		Make(OpPop),
+		Make(OpNull),
+		Make(OpJumpNotTruthy, 15),
+		Make(OpJump, 22),
+	)
+
+	fn := concat(
+		Make(OpGetLocal, 0),
+		Make(OpReturnValue),
+	)
+
+	constants := []Constant{
+		{Value: "10"},
+		{Value: "fn", Instructions: fn},
+	}
+
+	expected := `== main ==
+    0000 OpTrue
+    0001 OpJumpNotTruthy L1
+    0004 OpConstant 0             ; 10
+    0007 OpJump L2
+L1:
+    0010 OpClosure 1 0            ; fn
+    0014 OpPop
+L2:
+    0015 OpNull
+    0016 OpJumpNotTruthy L2
+    0019 OpJump L3
+L3:
+
+== constant 1: fn ==
+    0000 OpGetLocal 0
+    0002 OpReturnValue
+`
+
+	listing, err := Disassemble(main, constants)
+	if err != nil {
+		t.Fatalf("Disassemble failed: %s", err)
+	}
+
+	if listing != expected {
+		t.Errorf("wrong disassembly.\nwant = %q\ngot  = %q", expected, listing)
+	}
+}
+
+func TestDisassembleErrors(t *testing.T) {
+	tests := []struct {
+		main      Instructions
+		constants []Constant
+		expected  string
+	}{
+		{
+			Instructions{byte(OpPop), 255, byte(OpPop)},
+			nil,
+			"main: offset 0001: opcode 255 undefined",
+		},
+		{
+			concat(Make(OpPop), Make(OpConstant, 0)[:2]),
+			nil,
+			"main: offset 0001: OpConstant truncated",
+		},
+		{
+			Make(OpJump, 10),
+			nil,
+			"main: jump target 0010 out of range",
+		},
+		{
+			concat(Make(OpJump, 4), Make(OpConstant, 0)),
+			nil,
+			"main: jump target 0004 is not the start of an instruction",
+		},
+		{
+			Make(OpPop),
+			[]Constant{{Value: "1"}, {Value: "fn", Instructions: Instructions{254}}},
+			"constant 1: offset 0000: opcode 254 undefined",
+		},
+	}
+
+	for _, tt := range tests {
+		listing, err := Disassemble(tt.main, tt.constants)
+		if err == nil {
+			t.Errorf("expected error %q, got none", tt.expected)
+			continue
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want = %q, got = %q", tt.expected, err)
+		}
+
+		if !strings.HasPrefix(listing, "== main ==\n") {
+			t.Errorf("listing up to the error is missing. got = %q", listing)
+		}
+	}
+}
+
+func TestDisassembleInvalidJumpTarget(t *testing.T) {
+	// 0004 is the operand of the OpConstant starting at 0003
+	main := concat(
+		Make(OpJump, 4),     // 0000
+		Make(OpConstant, 0), // 0003
+		Make(OpJump, 6),     // 0006
+	)
+
+	expected := `== main ==
+    0000 OpJump 0004              ; invalid jump target
+    0003 OpConstant 0             ; 1
+L1:
+    0006 OpJump L1
+`
+
+	listing, err := Disassemble(main, []Constant{{Value: "1"}})
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+
+	if listing != expected {
+		t.Errorf("wrong disassembly.\nwant = %q\ngot  = %q", expected, listing)
+	}
+}
+
+func concat(instructions ...[]byte) Instructions {
+	out := Instructions{}
+	for _, ins := range instructions {
+		out = append(out, ins...)
+	}
+
+	return out
+}
+
+func TestDisassembleInstruction(t *testing.T) {
+	ins := concat(
+		Make(OpConstant, 0),       // 0000
+		Make(OpJumpNotTruthy, 10), // 0003
+		Make(OpAdd),               // 0006
+		Instructions{255},         // 0007
+		Make(OpGetLocal, 1)[:1],   // 0008
+	)
+	constants := []Constant{{Value: `"ode"`}}
+
+	tests := []struct {
+		offset   int
+		expected string
+		err      string
+	}{
+		{0, `0000 OpConstant 0             ; "ode"`, ""},
+		{3, "0003 OpJumpNotTruthy 0010", ""},
+		{6, "0006 OpAdd", ""},
+		{7, "", "offset 0007: opcode 255 undefined"},
+		{8, "", "offset 0008: OpGetLocal truncated"},
+		{9, "", "offset 0009 out of range"},
+	}
+
+	for _, tt := range tests {
+		text, err := DisassembleInstruction(ins, tt.offset, constants)
+
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+
+		if text != tt.expected || got != tt.err {
+			t.Errorf("offset %04d: want = %q (error %q), got = %q (error %q)", tt.offset, tt.expected, tt.err, text, got)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package code
+
+import "lookageek.com/ode/token"
+
+// pureOpcodes only push a value without any side effect, so a pure push directly
+// followed by an OpPop does nothing. OpGetGlobal and OpGetLocal are not pure,
+// they fail when the let statement binding the variable was not executed
+var pureOpcodes = map[Opcode]bool{
+	OpConstant:       true,
+	OpConstantWide:   true,
+	OpTrue:           true,
+	OpFalse:          true,
+	OpNull:           true,
+	OpGetBuiltin:     true,
+	OpGetFree:        true,
+	OpCurrentClosure: true,
+}
+
+// superinstructions are the fused forms of an OpConstant followed by an arithmetic opcode
+var superinstructions = map[Opcode]Opcode{
+	OpAdd: OpAddConstant,
+	OpSub: OpSubConstant,
+}
+
+// optimizable is an instruction while it is optimized, jumps refer to the index
+// of their target instruction instead of its offset so instructions can be removed
+type optimizable struct {
+	op       Opcode
+	operands []int
+	position token.Position
+	// target is the index of the instruction a jump jumps to, the number
+	// of instructions for a jump past the last instruction
+	target  int
+	removed bool
+}
+
+// Optimize runs the peephole optimizer over the instructions of a single function
+// (or the main program) and returns the optimized instructions with their positions.
+// The optimizer
+//   - collapses chains of jumps to jumps into a single jump
+//   - removes the unreachable instructions after OpJump, OpReturnValue and OpReturn,
+//     and jumps to the very next instruction
+//   - removes pure pushes which are popped right away, except for the final OpPop
+//     since its value is the result of the program
+//   - fuses OpConstant followed by OpAdd or OpSub into OpAddConstant or OpSubConstant
+//
+// Instructions which can not be decoded, or with jumps into the middle
+// of an instruction, are returned as they are
+func Optimize(ins Instructions, positions PositionTable) (Instructions, PositionTable) {
+	instructions, ok := toOptimizable(ins, positions)
+	if !ok {
+		return ins, positions
+	}
+
+	for changed := true; changed; {
+		changed = false
+
+		for _, pass := range []func([]*optimizable) bool{
+			collapseJumpChains,
+			removeUnreachable,
+			removePushPop,
+			fuseSuperinstructions,
+		} {
+			if pass(instructions) {
+				instructions = compact(instructions)
+				changed = true
+			}
+		}
+	}
+
+	return fromOptimizable(instructions)
+}
+
+func toOptimizable(ins Instructions, positions PositionTable) ([]*optimizable, bool) {
+	decodedInstructions, err := decode(ins)
+	if err != nil {
+		return nil, false
+	}
+
+	indexAt := make(map[int]int)
+	for i, in := range decodedInstructions {
+		indexAt[in.offset] = i
+	}
+	indexAt[len(ins)] = len(decodedInstructions)
+
+	instructions := []*optimizable{}
+	for _, in := range decodedInstructions {
+		o := &optimizable{op: in.op, operands: in.operands, position: positions.Lookup(in.offset)}
+
+		if isJump(in.op) {
+			target, ok := indexAt[in.operands[0]]
+			if !ok {
+				return nil, false
+			}
+			o.target = target
+		}
+
+		instructions = append(instructions, o)
+	}
+
+	return instructions, true
+}
+
+func fromOptimizable(instructions []*optimizable) (Instructions, PositionTable) {
+	offsets := make([]int, len(instructions)+1)
+	for i, in := range instructions {
+		offsets[i+1] = offsets[i] + 1 + definitions[in.op].operandsWidth()
+	}
+
+	ins := Instructions{}
+	var positions PositionTable
+
+	for i, in := range instructions {
+		if isJump(in.op) {
+			in.operands[0] = offsets[in.target]
+		}
+
+		if in.position.IsValid() && (len(positions) == 0 || positions[len(positions)-1].Position != in.position) {
+			positions = append(positions, PositionEntry{Offset: offsets[i], Position: in.position})
+		}
+
+		ins = append(ins, Make(in.op, in.operands...)...)
+	}
+
+	return ins, positions
+}
+
+// jumpTargets marks every instruction some jump jumps to
+func jumpTargets(instructions []*optimizable) map[int]bool {
+	targets := make(map[int]bool)
+	for _, in := range instructions {
+		if isJump(in.op) {
+			targets[in.target] = true
+		}
+	}
+
+	return targets
+}
+
+// compact drops the removed instructions, jumps to a removed
+// instruction continue with the next instruction that is kept
+func compact(instructions []*optimizable) []*optimizable {
+	newIndex := make([]int, len(instructions)+1)
+	kept := []*optimizable{}
+
+	for i, in := range instructions {
+		newIndex[i] = len(kept)
+		if !in.removed {
+			kept = append(kept, in)
+		}
+	}
+	newIndex[len(instructions)] = len(kept)
+
+	for _, in := range kept {
+		if isJump(in.op) {
+			in.target = newIndex[in.target]
+		}
+	}
+
+	return kept
+}
+
+func collapseJumpChains(instructions []*optimizable) bool {
+	changed := false
+
+	for _, in := range instructions {
+		if !isJump(in.op) {
+			continue
+		}
+
+		// an endless loop of jumps is left alone, seen stops following it
+		seen := map[int]bool{}
+		for in.target < len(instructions) && instructions[in.target].op == OpJump && !seen[in.target] {
+			seen[in.target] = true
+			in.target = instructions[in.target].target
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func removeUnreachable(instructions []*optimizable) bool {
+	changed := false
+	targets := jumpTargets(instructions)
+
+	for i, in := range instructions {
+		if in.removed {
+			continue
+		}
+
+		// a jump to the next instruction does nothing
+		if in.op == OpJump && in.target == i+1 {
+			in.removed = true
+			changed = true
+			continue
+		}
+
+		if in.op != OpJump && in.op != OpReturnValue && in.op != OpReturn {
+			continue
+		}
+
+		for j := i + 1; j < len(instructions) && !targets[j]; j++ {
+			instructions[j].removed = true
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func removePushPop(instructions []*optimizable) bool {
+	changed := false
+	targets := jumpTargets(instructions)
+
+	// the last instruction is never removed, the program's result is the value it pops
+	for i := 0; i+2 < len(instructions); i++ {
+		push, pop := instructions[i], instructions[i+1]
+		if push.removed || !pureOpcodes[push.op] || pop.op != OpPop || targets[i+1] {
+			continue
+		}
+
+		push.removed = true
+		pop.removed = true
+		changed = true
+	}
+
+	return changed
+}
+
+func fuseSuperinstructions(instructions []*optimizable) bool {
+	changed := false
+	targets := jumpTargets(instructions)
+
+	for i := 0; i+1 < len(instructions); i++ {
+		constant, operation := instructions[i], instructions[i+1]
+		fused, ok := superinstructions[operation.op]
+		if constant.removed || constant.op != OpConstant || !ok || targets[i+1] {
+			continue
+		}
+
+		// the fused instruction fails where the operation would have failed
+		operation.op = fused
+		operation.operands = constant.operands
+		constant.removed = true
+		changed = true
+	}
+
+	return changed
+}
@@ -0,0 +1,231 @@
+package code
+
+import (
+	"reflect"
+	"testing"
+
+	"lookageek.com/ode/token"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    Instructions
+		expected Instructions
+	}{
+		{
+			"pure push popped right away",
+			concat(
+				Make(OpConstant, 0),
+				Make(OpPop),
+				Make(OpGetBuiltin, 1),
+				Make(OpPop),
+				Make(OpTrue),
+				Make(OpPop),
+			),
+			concat(
+				Make(OpTrue),
+				Make(OpPop),
+			),
+		},
+		{
+			"reading a variable which can be unset is kept",
+			concat(
+				Make(OpGetGlobal, 1),
+				Make(OpPop),
+				Make(OpGetLocal, 0),
+				Make(OpPop),
+				Make(OpTrue),
+				Make(OpPop),
+			),
+			concat(
+				Make(OpGetGlobal, 1),
+				Make(OpPop),
+				Make(OpGetLocal, 0),
+				Make(OpPop),
+				Make(OpTrue),
+				Make(OpPop),
+			),
+		},
+		{
+			"push with a side effect is kept",
+			concat(
+				Make(OpConstant, 0),
+				Make(OpCall, 0),
+				Make(OpPop),
+				Make(OpNull),
+				Make(OpPop),
+			),
+			concat(
+				Make(OpConstant, 0),
+				Make(OpCall, 0),
+				Make(OpPop),
+				Make(OpNull),
+				Make(OpPop),
+			),
+		},
+		{
+			"popping a jump target is kept",
+			concat(
+				Make(OpTrue),              // 0000
+				Make(OpJumpNotTruthy, 10), // 0001
+				Make(OpConstant, 0),       // 0004
+				Make(OpJump, 11),          // 0007
+				Make(OpNull),              // 0010
+				Make(OpPop),               // 0011
+				Make(OpNull),              // 0012
+				Make(OpPop),               // 0013
+			),
+			concat(
+				Make(OpTrue),
+				Make(OpJumpNotTruthy, 10),
+				Make(OpConstant, 0),
+				Make(OpJump, 11),
+				Make(OpNull),
+				Make(OpPop),
+				Make(OpNull),
+				Make(OpPop),
+			),
+		},
+		{
+			"unreachable code after a return",
+			concat(
+				Make(OpGetLocal, 0),
+				Make(OpReturnValue),
+				Make(OpNull),
+				Make(OpPop),
+				Make(OpReturn),
+			),
+			concat(
+				Make(OpGetLocal, 0),
+				Make(OpReturnValue),
+			),
+		},
+		{
+			"jump chains",
+			concat(
+				Make(OpTrue),              // 0000
+				Make(OpJumpNotTruthy, 10), // 0001
+				Make(OpConstant, 0),       // 0004
+				Make(OpJump, 10),          // 0007
+				Make(OpJump, 17),          // 0010
+				Make(OpConstant, 1),       // 0013 unreachable
+				Make(OpPop),               // 0016
+				Make(OpNull),              // 0017
+				Make(OpPop),               // 0018
+			),
+			// both jumps go straight to 0017, the OpJump then jumps to the next instruction
+			concat(
+				Make(OpTrue),             // 0000
+				Make(OpJumpNotTruthy, 7), // 0001
+				Make(OpConstant, 0),      // 0004
+				Make(OpNull),             // 0007
+				Make(OpPop),              // 0008
+			),
+		},
+		{
+			"jump to the next instruction",
+			concat(
+				Make(OpTrue),
+				Make(OpJump, 4),
+				Make(OpPop),
+			),
+			concat(
+				Make(OpTrue),
+				Make(OpPop),
+			),
+		},
+		{
+			"superinstructions",
+			concat(
+				Make(OpGetLocal, 0),
+				Make(OpConstant, 1),
+				Make(OpSub),
+				Make(OpConstant, 2),
+				Make(OpAdd),
+				Make(OpConstant, 3),
+				Make(OpMul),
+				Make(OpReturnValue),
+			),
+			concat(
+				Make(OpGetLocal, 0),
+				Make(OpSubConstant, 1),
+				Make(OpAddConstant, 2),
+				Make(OpConstant, 3),
+				Make(OpMul),
+				Make(OpReturnValue),
+			),
+		},
+		{
+			"jump into the middle of an instruction is left alone",
+			concat(
+				Make(OpJump, 4),
+				Make(OpConstant, 0),
+				Make(OpPop),
+				Make(OpNull),
+				Make(OpPop),
+			),
+			concat(
+				Make(OpJump, 4),
+				Make(OpConstant, 0),
+				Make(OpPop),
+				Make(OpNull),
+				Make(OpPop),
+			),
+		},
+		{
+			"undefined opcode is left alone",
+			Instructions{byte(OpNull), byte(OpPop), 255, byte(OpNull), byte(OpPop)},
+			Instructions{byte(OpNull), byte(OpPop), 255, byte(OpNull), byte(OpPop)},
+		},
+	}
+
+	for _, tt := range tests {
+		optimized, _ := Optimize(tt.input, nil)
+
+		if !reflect.DeepEqual(optimized, tt.expected) {
+			t.Errorf("%s: wrong instructions.\nwant =\n%s\ngot =\n%s", tt.name, tt.expected, optimized)
+		}
+	}
+}
+
+func TestOptimizeKeepsPositions(t *testing.T) {
+	ins := concat(
+		Make(OpNull),        // 0000 removed with the OpPop
+		Make(OpPop),         // 0001
+		Make(OpGetLocal, 0), // 0002
+		Make(OpConstant, 0), // 0004 fused into the OpAdd
+		Make(OpAdd),         // 0007
+		Make(OpReturnValue), // 0008
+	)
+
+	positions := PositionTable{
+		{Offset: 0, Position: token.Position{Line: 1, Column: 1}},
+		{Offset: 2, Position: token.Position{Line: 2, Column: 1}},
+		{Offset: 4, Position: token.Position{Line: 2, Column: 5}},
+		{Offset: 7, Position: token.Position{Line: 2, Column: 3}},
+		{Offset: 8, Position: token.Position{Line: 2, Column: 1}},
+	}
+
+	expectedInstructions := concat(
+		Make(OpGetLocal, 0),    // 0000
+		Make(OpAddConstant, 0), // 0002
+		Make(OpReturnValue),    // 0005
+	)
+
+	expectedPositions := PositionTable{
+		{Offset: 0, Position: token.Position{Line: 2, Column: 1}},
+		{Offset: 2, Position: token.Position{Line: 2, Column: 3}},
+		{Offset: 5, Position: token.Position{Line: 2, Column: 1}},
+	}
+
+	optimized, optimizedPositions := Optimize(ins, positions)
+
+	if !reflect.DeepEqual(optimized, expectedInstructions) {
+		t.Errorf("wrong instructions.\nwant =\n%s\ngot =\n%s", expectedInstructions, optimized)
+	}
+
+	if !reflect.DeepEqual(optimizedPositions, expectedPositions) {
+		t.Errorf("wrong positions.\nwant = %+v\ngot  = %+v", expectedPositions, optimizedPositions)
+	}
+}
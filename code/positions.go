@@ -0,0 +1,30 @@
+package code
+
+import (
+	"sort"
+
+	"lookageek.com/ode/token"
+)
+
+// PositionTable maps instruction offsets back to the source positions of the ast nodes
+// they were compiled from. The entries are sorted by offset and every entry covers
+// the instructions up to the offset of the next entry
+type PositionTable []PositionEntry
+
+// PositionEntry is a single entry of the PositionTable
+type PositionEntry struct {
+	Offset   int
+	Position token.Position
+}
+
+// Lookup finds the source position of the instruction at offset, any offset inside
+// the instruction works too. The zero Position is returned when it is not known
+func (pt PositionTable) Lookup(offset int) token.Position {
+	// index of the first entry after offset, the entry before it covers the offset
+	i := sort.Search(len(pt), func(i int) bool { return pt[i].Offset > offset })
+	if i == 0 {
+		return token.Position{}
+	}
+
+	return pt[i-1].Position
+}
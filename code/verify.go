@@ -0,0 +1,207 @@
+package code
+
+import "fmt"
+
+// Limits are the bounds Verify checks the operands of a function's instructions against
+type Limits struct {
+	Constants int
+	Globals   int
+	Builtins  int
+	Locals    int
+	Free      int
+	// Function is set for the instructions of a function, which have to
+	// return instead of running past their last instruction
+	Function bool
+}
+
+// stackEffects are the number of values an opcode pops and pushes, the pops of OpArray,
+// OpHash, OpCall, OpTailCall, OpClosure and OpClosureWide depend on their operands, see stackEffect
+var stackEffects = map[Opcode][2]int{
+	OpConstant:       {0, 1},
+	OpConstantWide:   {0, 1},
+	OpAdd:            {2, 1},
+	OpSub:            {2, 1},
+	OpMul:            {2, 1},
+	OpDiv:            {2, 1},
+	OpEqual:          {2, 1},
+	OpNotEqual:       {2, 1},
+	OpGreaterThan:    {2, 1},
+	OpLessThan:       {2, 1},
+	OpPop:            {1, 0},
+	OpTrue:           {0, 1},
+	OpFalse:          {0, 1},
+	OpMinus:          {1, 1},
+	OpBang:           {1, 1},
+	OpJumpNotTruthy:  {1, 0},
+	OpJump:           {0, 0},
+	OpNull:           {0, 1},
+	OpSetGlobal:      {1, 0},
+	OpGetGlobal:      {0, 1},
+	OpIndex:          {2, 1},
+	OpReturnValue:    {1, 0},
+	OpReturn:         {0, 0},
+	OpSetLocal:       {1, 0},
+	OpGetLocal:       {0, 1},
+	OpGetBuiltin:     {0, 1},
+	OpGetFree:        {0, 1},
+	OpCurrentClosure: {0, 1},
+	OpAddConstant:    {1, 1},
+	OpSubConstant:    {1, 1},
+}
+
+func stackEffect(in decoded) (pops, pushes int) {
+	switch in.op {
+	case OpArray, OpHash:
+		return in.operands[0], 1
+	case OpCall, OpTailCall:
+		// the callee below the arguments is replaced by the result, a tail call
+		// of a closure never continues but the call of a builtin does
+		return in.operands[0] + 1, 1
+	case OpClosure, OpClosureWide:
+		return in.operands[1], 1
+	default:
+		effect := stackEffects[in.op]
+		return effect[0], effect[1]
+	}
+}
+
+// Verify checks the instructions of a single function (or the main program) before
+// they are executed, it fails with the offset of the first offending instruction
+//   - every opcode is defined and no instruction is truncated
+//   - jumps land on the start of an instruction, or right past the last instruction
+//     of the main program
+//   - constant, global, builtin, local and free variable indexes are within the limits
+//     and OpHash pairs up its keys and values
+//   - every path reaching an instruction has the same number of values on the stack,
+//     no instruction pops more values than there are and a function never runs past
+//     its last instruction
+func Verify(ins Instructions, limits Limits) error {
+	instructions, err := decode(ins)
+	if err != nil {
+		return err
+	}
+
+	indexAt := make(map[int]int)
+	for i, in := range instructions {
+		indexAt[in.offset] = i
+	}
+	indexAt[len(ins)] = len(instructions)
+
+	for _, in := range instructions {
+		err := verifyOperands(in, limits)
+		if err != nil {
+			return fmt.Errorf("offset %04d: %s", in.offset, err)
+		}
+
+		if !isJump(in.op) {
+			continue
+		}
+
+		if _, ok := indexAt[in.operands[0]]; !ok {
+			return fmt.Errorf("offset %04d: %s to %04d which is not the start of an instruction",
+				in.offset, in.def.Name, in.operands[0])
+		}
+	}
+
+	return verifyStack(instructions, indexAt, limits.Function)
+}
+
+func verifyOperands(in decoded, limits Limits) error {
+	checkIndex := func(kind string, index, limit int) error {
+		if index >= limit {
+			return fmt.Errorf("%s %s %d out of range, there are %d", in.def.Name, kind, index, limit)
+		}
+		return nil
+	}
+
+	switch in.op {
+	case OpConstant, OpConstantWide, OpAddConstant, OpSubConstant, OpClosure, OpClosureWide:
+		return checkIndex("constant", in.operands[0], limits.Constants)
+	case OpSetGlobal, OpGetGlobal:
+		return checkIndex("global", in.operands[0], limits.Globals)
+	case OpGetBuiltin:
+		return checkIndex("builtin", in.operands[0], limits.Builtins)
+	case OpSetLocal, OpGetLocal:
+		return checkIndex("local", in.operands[0], limits.Locals)
+	case OpGetFree:
+		return checkIndex("free variable", in.operands[0], limits.Free)
+	case OpHash:
+		if in.operands[0]%2 != 0 {
+			return fmt.Errorf("OpHash of %d elements, keys and values have to pair up", in.operands[0])
+		}
+	}
+
+	return nil
+}
+
+// verifyStack follows every path through the instructions and tracks the
+// number of values on the stack, relative to the locals of the function
+func verifyStack(instructions []decoded, indexAt map[int]int, function bool) error {
+	heights := make([]int, len(instructions)+1)
+	for i := range heights {
+		heights[i] = -1
+	}
+
+	if function && len(instructions) == 0 {
+		return fmt.Errorf("offset 0000: function runs past its last instruction")
+	}
+
+	heights[0] = 0
+	worklist := []int{0}
+
+	for len(worklist) > 0 {
+		i := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		if i == len(instructions) {
+			continue
+		}
+
+		in := instructions[i]
+		pops, pushes := stackEffect(in)
+		if pops > heights[i] {
+			return fmt.Errorf("offset %04d: %s pops %d values, the stack has %d",
+				in.offset, in.def.Name, pops, heights[i])
+		}
+		height := heights[i] - pops + pushes
+
+		var successors []int
+		switch in.op {
+		case OpReturnValue, OpReturn:
+		case OpJump:
+			successors = []int{indexAt[in.operands[0]]}
+		case OpJumpNotTruthy:
+			successors = []int{i + 1, indexAt[in.operands[0]]}
+		default:
+			successors = []int{i + 1}
+		}
+
+		for _, successor := range successors {
+			if successor == len(instructions) && function {
+				return fmt.Errorf("offset %04d: function runs past its last instruction", in.offset)
+			}
+
+			switch heights[successor] {
+			case -1:
+				heights[successor] = height
+				worklist = append(worklist, successor)
+			case height:
+			default:
+				return fmt.Errorf("offset %04d: stack height %d from offset %04d, %d from another path",
+					offsetOf(instructions, successor), height, in.offset, heights[successor])
+			}
+		}
+	}
+
+	return nil
+}
+
+// offsetOf is the offset of the instruction at index i, or the end of the instructions
+func offsetOf(instructions []decoded, i int) int {
+	if i < len(instructions) {
+		return instructions[i].offset
+	}
+
+	last := instructions[len(instructions)-1]
+	return last.offset + 1 + last.def.operandsWidth()
+}
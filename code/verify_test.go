@@ -0,0 +1,172 @@
+package code
+
+import "testing"
+
+func TestVerify(t *testing.T) {
+	main := Limits{Constants: 2, Globals: 4, Builtins: 1}
+	function := Limits{Constants: 2, Globals: 4, Builtins: 1, Locals: 1, Free: 1, Function: true}
+
+	tests := []struct {
+		name     string
+		input    Instructions
+		limits   Limits
+		expected string
+	}{
+		{
+			"if else in the main program",
+			concat(
+				Make(OpTrue),              // 0000
+				Make(OpJumpNotTruthy, 10), // 0001
+				Make(OpConstant, 0),       // 0004
+				Make(OpJump, 11),          // 0007
+				Make(OpNull),              // 0010
+				Make(OpPop),               // 0011
+			),
+			main,
+			"",
+		},
+		{
+			"function using all of its limits",
+			concat(
+				Make(OpGetLocal, 0),
+				Make(OpGetFree, 0),
+				Make(OpGetBuiltin, 0),
+				Make(OpGetGlobal, 3),
+				Make(OpCall, 2),
+				Make(OpAddConstant, 1),
+				Make(OpReturnValue),
+			),
+			function,
+			"",
+		},
+		{
+			"jump past the last instruction of the main program",
+			concat(
+				Make(OpTrue),
+				Make(OpJumpNotTruthy, 4),
+			),
+			main,
+			"",
+		},
+		{"empty main program", Instructions{}, main, ""},
+		{
+			"undefined opcode",
+			Instructions{byte(OpNull), 255},
+			main,
+			"offset 0001: opcode 255 undefined",
+		},
+		{
+			"truncated instruction",
+			Make(OpConstant, 0)[:2],
+			main,
+			"offset 0000: OpConstant truncated",
+		},
+		{
+			"jump into the middle of an instruction",
+			concat(
+				Make(OpJump, 4),
+				Make(OpConstant, 0),
+			),
+			main,
+			"offset 0000: OpJump to 0004 which is not the start of an instruction",
+		},
+		{
+			"jump out of range",
+			Make(OpJump, 100),
+			main,
+			"offset 0000: OpJump to 0100 which is not the start of an instruction",
+		},
+		{
+			"constant out of range",
+			Make(OpConstant, 2),
+			main,
+			"offset 0000: OpConstant constant 2 out of range, there are 2",
+		},
+		{
+			"global out of range",
+			Make(OpGetGlobal, 4),
+			main,
+			"offset 0000: OpGetGlobal global 4 out of range, there are 4",
+		},
+		{
+			"builtin out of range",
+			Make(OpGetBuiltin, 1),
+			main,
+			"offset 0000: OpGetBuiltin builtin 1 out of range, there are 1",
+		},
+		{
+			"local in the main program",
+			Make(OpGetLocal, 0),
+			main,
+			"offset 0000: OpGetLocal local 0 out of range, there are 0",
+		},
+		{
+			"free variable out of range",
+			concat(Make(OpGetFree, 1), Make(OpReturnValue)),
+			function,
+			"offset 0000: OpGetFree free variable 1 out of range, there are 1",
+		},
+		{
+			"hash of an odd number of elements",
+			concat(Make(OpTrue), Make(OpHash, 1)),
+			main,
+			"offset 0001: OpHash of 1 elements, keys and values have to pair up",
+		},
+		{
+			"popping an empty stack",
+			concat(Make(OpTrue), Make(OpAdd)),
+			main,
+			"offset 0001: OpAdd pops 2 values, the stack has 1",
+		},
+		{
+			"calling without a callee",
+			concat(Make(OpTrue), Make(OpCall, 1)),
+			main,
+			"offset 0001: OpCall pops 2 values, the stack has 1",
+		},
+		{
+			"branches leaving different stack heights",
+			concat(
+				Make(OpTrue),             // 0000
+				Make(OpJumpNotTruthy, 9), // 0001
+				Make(OpTrue),             // 0004
+				Make(OpTrue),             // 0005
+				Make(OpJump, 10),         // 0006
+				Make(OpNull),             // 0009
+				Make(OpPop),              // 0010
+			),
+			main,
+			"offset 0010: stack height 2 from offset 0006, 1 from another path",
+		},
+		{
+			"function running past its last instruction",
+			concat(Make(OpTrue), Make(OpPop)),
+			function,
+			"offset 0001: function runs past its last instruction",
+		},
+		{
+			"function jumping past its last instruction",
+			concat(
+				Make(OpTrue),
+				Make(OpJumpNotTruthy, 5),
+				Make(OpReturn),
+			),
+			function,
+			"offset 0001: function runs past its last instruction",
+		},
+		{"empty function", Instructions{}, function, "offset 0000: function runs past its last instruction"},
+	}
+
+	for _, tt := range tests {
+		err := Verify(tt.input, tt.limits)
+
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+
+		if got != tt.expected {
+			t.Errorf("%s: wrong error. want = %q, got = %q", tt.name, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/object"
+	"lookageek.com/ode/token"
+)
+
+// Bytecode files start with a fixed header followed by the payload:
+//
+//	magic        4 bytes  "ODE\x00"
+//	version      uint16   FileFormatVersion
+//	fingerprint  uint32   code.Fingerprint() of the opcode set which compiled the file
+//	length       uint32   length of the payload
+//	checksum     uint32   CRC-32 (IEEE) of the payload
+//
+// the payload holds the source file name, the main instructions with their position
+// table, the names of the globals and then the constant pool, each constant is a one
+// byte tag and the value. All numbers are big-endian like the operands in the instructions
+const FileFormatVersion = 3
+
+var fileMagic = []byte("ODE\x00")
+
+const headerLen = 4 + 2 + 4 + 4 + 4
+
+// tags of the constants in the constant pool of a bytecode file
+const (
+	integerTag          byte = 1
+	stringTag           byte = 2
+	compiledFunctionTag byte = 3
+)
+
+// WriteBytecode serializes the bytecode into the bytecode file format
+func WriteBytecode(w io.Writer, bytecode *Bytecode) error {
+	var payload bytes.Buffer
+
+	writeString(&payload, bytecode.File)
+	writeInstructions(&payload, bytecode.Instructions)
+	writePositions(&payload, bytecode.Positions)
+	writeNames(&payload, bytecode.GlobalNames)
+
+	writeUint32(&payload, uint32(len(bytecode.Constants)))
+	for i, constant := range bytecode.Constants {
+		err := writeConstant(&payload, constant)
+		if err != nil {
+			return fmt.Errorf("constant %d: %s", i, err)
+		}
+	}
+
+	var header bytes.Buffer
+	header.Write(fileMagic)
+	writeUint16(&header, FileFormatVersion)
+	writeUint32(&header, code.Fingerprint())
+	writeUint32(&header, uint32(payload.Len()))
+	writeUint32(&header, crc32.ChecksumIEEE(payload.Bytes()))
+
+	_, err := w.Write(append(header.Bytes(), payload.Bytes()...))
+	return err
+}
+
+// ReadBytecode deserializes a bytecode file, files of another format version, compiled
+// with an incompatible opcode set or with a payload not matching its checksum are refused
+func ReadBytecode(r io.Reader) (*Bytecode, error) {
+	header := make([]byte, headerLen)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("not an ode bytecode file: %s", err)
+	}
+
+	if !bytes.Equal(header[:4], fileMagic) {
+		return nil, fmt.Errorf("not an ode bytecode file")
+	}
+
+	version := binary.BigEndian.Uint16(header[4:])
+	if version != FileFormatVersion {
+		return nil, fmt.Errorf("unsupported bytecode file version %d, want %d", version, FileFormatVersion)
+	}
+
+	fingerprint := binary.BigEndian.Uint32(header[6:])
+	if fingerprint != code.Fingerprint() {
+		return nil, fmt.Errorf("bytecode file was compiled with an incompatible opcode set")
+	}
+
+	length := binary.BigEndian.Uint32(header[10:])
+	checksum := binary.BigEndian.Uint32(header[14:])
+
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint32(len(payload)) > length {
+		return nil, fmt.Errorf("bytecode file has %d bytes after its payload", uint32(len(payload))-length)
+	}
+
+	if uint32(len(payload)) != length || crc32.ChecksumIEEE(payload) != checksum {
+		return nil, fmt.Errorf("bytecode file is corrupt, checksum mismatch")
+	}
+
+	d := &decoder{payload: payload}
+
+	file := d.string()
+	instructions := d.instructions()
+	positions := d.positions()
+	globalNames := d.names()
+
+	constants := []object.Object{}
+	for i := d.uint32(); i > 0 && d.err == nil; i-- {
+		constants = append(constants, d.constant())
+	}
+
+	if d.err == nil && d.offset != len(payload) {
+		d.err = fmt.Errorf("%d bytes after the constant pool", len(payload)-d.offset)
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("bytecode file is corrupt: %s", d.err)
+	}
+
+	return &Bytecode{
+		Instructions: instructions,
+		Constants:    constants,
+		Positions:    positions,
+		File:         file,
+		GlobalNames:  globalNames,
+	}, nil
+}
+
+func writeConstant(buf *bytes.Buffer, constant object.Object) error {
+	switch constant := constant.(type) {
+	case *object.Integer:
+		buf.WriteByte(integerTag)
+		writeUint64(buf, uint64(constant.Value))
+
+	case *object.String:
+		buf.WriteByte(stringTag)
+		writeString(buf, constant.Value)
+
+	case *object.CompiledFunction:
+		// both counts are written as uint16
+		if constant.NumLocals > math.MaxUint16 || constant.NumParameters > math.MaxUint16 {
+			return fmt.Errorf("function with %d locals and %d parameters, at most %d of each can be written",
+				constant.NumLocals, constant.NumParameters, math.MaxUint16)
+		}
+
+		buf.WriteByte(compiledFunctionTag)
+		writeString(buf, constant.Name)
+		writeUint16(buf, uint16(constant.NumLocals))
+		writeUint16(buf, uint16(constant.NumParameters))
+		writeInstructions(buf, constant.Instructions)
+		writePositions(buf, constant.Positions)
+		writeNames(buf, constant.LocalNames)
+
+	default:
+		return fmt.Errorf("cannot serialize %s constant", constant.Type())
+	}
+
+	return nil
+}
+
+func writeInstructions(buf *bytes.Buffer, ins code.Instructions) {
+	writeUint32(buf, uint32(len(ins)))
+	buf.Write(ins)
+}
+
+func writePositions(buf *bytes.Buffer, positions code.PositionTable) {
+	writeUint32(buf, uint32(len(positions)))
+	for _, entry := range positions {
+		writeUint32(buf, uint32(entry.Offset))
+		writeUint32(buf, uint32(entry.Position.Line))
+		writeUint32(buf, uint32(entry.Position.Column))
+	}
+}
+
+func writeNames(buf *bytes.Buffer, names []string) {
+	writeUint32(buf, uint32(len(names)))
+	for _, name := range names {
+		writeString(buf, name)
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUint32(buf, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func writeUint16(buf *bytes.Buffer, n uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], n)
+	buf.Write(b[:])
+}
+
+func writeUint32(buf *bytes.Buffer, n uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	buf.Write(b[:])
+}
+
+func writeUint64(buf *bytes.Buffer, n uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	buf.Write(b[:])
+}
+
+// decoder reads the payload of a bytecode file, the first error is kept
+// and all reads after it return zero values
+type decoder struct {
+	payload []byte
+	offset  int
+	err     error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(d.payload)-d.offset < n {
+		d.err = fmt.Errorf("unexpected end of payload at offset %d", d.offset)
+		return nil
+	}
+
+	b := d.payload[d.offset : d.offset+n]
+	d.offset += n
+
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) instructions() code.Instructions {
+	n := d.uint32()
+	b := d.next(int(n))
+
+	ins := make(code.Instructions, len(b))
+	copy(ins, b)
+
+	return ins
+}
+
+func (d *decoder) positions() code.PositionTable {
+	var positions code.PositionTable
+
+	for i := d.uint32(); i > 0 && d.err == nil; i-- {
+		offset := d.uint32()
+		line := d.uint32()
+		column := d.uint32()
+
+		positions = append(positions, code.PositionEntry{
+			Offset:   int(offset),
+			Position: token.Position{Line: int(line), Column: int(column)},
+		})
+	}
+
+	return positions
+}
+
+func (d *decoder) names() []string {
+	names := []string{}
+
+	for i := d.uint32(); i > 0 && d.err == nil; i-- {
+		names = append(names, d.string())
+	}
+
+	return names
+}
+
+func (d *decoder) string() string {
+	n := d.uint32()
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) constant() object.Object {
+	tag := d.byte()
+	if d.err != nil {
+		return nil
+	}
+
+	switch tag {
+	case integerTag:
+		return &object.Integer{Value: int64(d.uint64())}
+
+	case stringTag:
+		return &object.String{Value: d.string()}
+
+	case compiledFunctionTag:
+		name := d.string()
+		numLocals := d.uint16()
+		numParameters := d.uint16()
+		instructions := d.instructions()
+		positions := d.positions()
+
+		return &object.CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     int(numLocals),
+			NumParameters: int(numParameters),
+			Name:          name,
+			Positions:     positions,
+			LocalNames:    d.names(),
+		}
+
+	default:
+		d.err = fmt.Errorf("unknown constant tag %d at offset %d", tag, d.offset-1)
+		return nil
+	}
+}
@@ -0,0 +1,160 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"lookageek.com/ode/object"
+)
+
+func TestBytecodeFileRoundTrip(t *testing.T) {
+	inputs := []string{
+		"1 + 2",
+		`"ode" + "lang"`,
+		"let a = -9223372036854775807 - 1; [a, {true: a}][0]",
+		"let newAdder = fn(a, b) { fn(c) { a + b + c } }; newAdder(1, 2)(3);",
+		"let countDown = fn(x) { if (x == 0) { return 0; } countDown(x - 1); }; countDown(1);",
+		`len("four")`,
+	}
+
+	for _, input := range inputs {
+		comp := New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := comp.Bytecode()
+		bytecode.File = "roundtrip.ode"
+
+		var buf bytes.Buffer
+		err = WriteBytecode(&buf, bytecode)
+		if err != nil {
+			t.Fatalf("WriteBytecode failed: %s", err)
+		}
+
+		read, err := ReadBytecode(&buf)
+		if err != nil {
+			t.Fatalf("ReadBytecode failed: %s", err)
+		}
+
+		if !reflect.DeepEqual(read, bytecode) {
+			t.Errorf("%q: bytecode changed in the round trip.\nwant = %+v\ngot  = %+v", input, bytecode, read)
+		}
+	}
+}
+
+func TestReadBytecodeRefusesBadFiles(t *testing.T) {
+	comp := New()
+	err := comp.Compile(parse(`let f = fn(x) { x + "ode" }; f("lang")`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	err = WriteBytecode(&buf, comp.Bytecode())
+	if err != nil {
+		t.Fatalf("WriteBytecode failed: %s", err)
+	}
+	file := buf.Bytes()
+
+	tests := []struct {
+		name     string
+		modify   func(b []byte) []byte
+		expected string
+	}{
+		{
+			"empty",
+			func(b []byte) []byte { return nil },
+			"not an ode bytecode file",
+		},
+		{
+			"magic",
+			func(b []byte) []byte { b[0] = 'X'; return b },
+			"not an ode bytecode file",
+		},
+		{
+			"version",
+			func(b []byte) []byte { binary.BigEndian.PutUint16(b[4:], FileFormatVersion+1); return b },
+			"unsupported bytecode file version",
+		},
+		{
+			"opcode set",
+			func(b []byte) []byte { b[6] ^= 0xff; return b },
+			"incompatible opcode set",
+		},
+		{
+			"flipped payload byte",
+			func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b },
+			"checksum mismatch",
+		},
+		{
+			"truncated payload",
+			func(b []byte) []byte { return b[:len(b)-3] },
+			"checksum mismatch",
+		},
+		{
+			"concatenated files",
+			func(b []byte) []byte { return append(b, b...) },
+			fmt.Sprintf("has %d bytes after its payload", len(file)),
+		},
+		{
+			"bytes after the constant pool",
+			func(b []byte) []byte {
+				// the length and the checksum of the header cover the extra byte
+				b = append(b, 0)
+				binary.BigEndian.PutUint32(b[10:], uint32(len(b)-headerLen))
+				binary.BigEndian.PutUint32(b[14:], crc32.ChecksumIEEE(b[headerLen:]))
+				return b
+			},
+			"bytecode file is corrupt: 1 bytes after the constant pool",
+		},
+	}
+
+	for _, tt := range tests {
+		modified := tt.modify(append([]byte{}, file...))
+
+		_, err := ReadBytecode(bytes.NewReader(modified))
+		if err == nil {
+			t.Errorf("%s: expected error, got none", tt.name)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: wrong error. want = %q, got = %q", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestWriteBytecodeRefusesLargeFunctions(t *testing.T) {
+	tests := []struct {
+		fn       *object.CompiledFunction
+		expected string
+	}{
+		{
+			&object.CompiledFunction{NumLocals: 65536},
+			"constant 0: function with 65536 locals and 0 parameters, at most 65535 of each can be written",
+		},
+		{
+			&object.CompiledFunction{NumLocals: 70000, NumParameters: 70000},
+			"constant 0: function with 70000 locals and 70000 parameters, at most 65535 of each can be written",
+		},
+	}
+
+	for _, tt := range tests {
+		err := WriteBytecode(ioutil.Discard, &Bytecode{Constants: []object.Object{tt.fn}})
+		if err == nil {
+			t.Errorf("expected error, got none")
+			continue
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want = %q, got = %q", tt.expected, err)
+		}
+	}
+}
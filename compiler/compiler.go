@@ -2,34 +2,141 @@ package compiler
 
 import (
 	"fmt"
+	"math"
+	"sort"
 
 	"lookageek.com/ode/ast"
 	"lookageek.com/ode/code"
 	"lookageek.com/ode/object"
+	"lookageek.com/ode/token"
 )
 
 // Compiler struct stores the compiled instructions (after calling Compile) and also
 // the constants which are discovered by the Compile method
 type Compiler struct {
-	instructions code.Instructions
-	constants    []object.Object
+	constants []object.Object
+
+	// constantIndexes interns integer and string constants, equal
+	// values share the index of the first constant added for them
+	constantIndexes map[constantKey]int
+
+	symbolTable *SymbolTable
+
+	// every function literal is compiled in its own scope, the instructions
+	// are always emitted into the scope at scopeIndex
+	scopes     []CompilationScope
+	scopeIndex int
+
+	// position is the source position of the innermost node being
+	// compiled, every emitted instruction is mapped back to it
+	position token.Position
+
+	// optimize runs code.Optimize over every compiled function and the main program
+	optimize bool
+
+	// operandErr is the first operand which did not fit into its instruction,
+	// Compile fails with it instead of emitting a truncated operand
+	operandErr error
+}
+
+// constantKey identifies an interned constant by its type and printed value
+type constantKey struct {
+	Type  object.ObjectType
+	Value string
+}
+
+// CompilationScope holds the instructions of a function body (or the main program)
+// while it is being compiled. lastInstruction and previousInstruction keep track of
+// the two most recently emitted instructions, so that a trailing OpPop can be removed.
+// positions maps the instructions back to the source
+type CompilationScope struct {
+	instructions        code.Instructions
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+	positions           code.PositionTable
+}
+
+// EmittedInstruction is the opcode of an already emitted instruction
+// and the position in the instructions at which it was emitted
+type EmittedInstruction struct {
+	Opcode   code.Opcode
+	Position int
 }
 
 // Bytecode is the package boundary between VM and compiler, once the compiler creates the
-// instructions and the constants, we will package them into Bytecode and hand it over to VM
+// instructions and the constants, we will package them into Bytecode and hand it over to VM.
+// Positions maps the instructions back to the source, File is the name of the source file
+// which is left empty by the compiler and set by whoever knows where the source came from
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	Positions    code.PositionTable
+	File         string
+	// GlobalNames are the names of the global bindings indexed by their slot
+	GlobalNames []string
 }
 
 func New() *Compiler {
+	mainScope := CompilationScope{
+		instructions:        code.Instructions{},
+		lastInstruction:     EmittedInstruction{},
+		previousInstruction: EmittedInstruction{},
+	}
+
 	return &Compiler{
-		instructions: code.Instructions{},
-		constants:    []object.Object{},
+		constants:       []object.Object{},
+		constantIndexes: make(map[constantKey]int),
+		symbolTable:     NewSymbolTableWithBuiltins(),
+		scopes:          []CompilationScope{mainScope},
+		scopeIndex:      0,
+		optimize:        true,
 	}
 }
 
+// SetOptimizations turns the peephole optimizer on or off, it is on by default
+func (c *Compiler) SetOptimizations(enabled bool) {
+	c.optimize = enabled
+}
+
+// NewSymbolTableWithBuiltins creates the global symbol table with
+// every builtin of object.Builtins defined in it
+func NewSymbolTableWithBuiltins() *SymbolTable {
+	symbolTable := NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	return symbolTable
+}
+
+// NewWithState creates a compiler which continues with the symbol table and
+// constants of an earlier compilation, so the REPL keeps its bindings across lines.
+// The symbol table needs to have the builtins defined, see NewSymbolTableWithBuiltins
+func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
+	compiler := New()
+	compiler.symbolTable = s
+	compiler.constants = constants
+
+	for i, constant := range constants {
+		if key, ok := internKey(constant); ok {
+			if _, seen := compiler.constantIndexes[key]; !seen {
+				compiler.constantIndexes[key] = i
+			}
+		}
+	}
+
+	return compiler
+}
+
 func (c *Compiler) Compile(node ast.Node) error {
+	// the instructions are attributed to the innermost node with a known position
+	// and the enclosing node's position is restored once this node is compiled
+	if position := node.Pos(); position.IsValid() {
+		enclosing := c.position
+		c.position = position
+		defer func() { c.position = enclosing }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, statement := range node.Statements {
@@ -44,6 +151,23 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err != nil {
 			return err
 		}
+		// an expression statement's value is never used again, so pop it off
+		c.emit(code.OpPop)
+
+	case *ast.PrefixExpression:
+		err := c.Compile(node.Right)
+		if err != nil {
+			return err
+		}
+
+		switch node.Operator {
+		case "!":
+			c.emit(code.OpBang)
+		case "-":
+			c.emit(code.OpMinus)
+		default:
+			return fmt.Errorf("unknown operator %s", node.Operator)
+		}
 
 	case *ast.InfixExpression:
 		err := c.Compile(node.Left)
@@ -59,42 +183,506 @@ func (c *Compiler) Compile(node ast.Node) error {
 		switch node.Operator {
 		case "+":
 			c.emit(code.OpAdd)
+		case "-":
+			c.emit(code.OpSub)
+		case "*":
+			c.emit(code.OpMul)
+		case "/":
+			c.emit(code.OpDiv)
+		case ">":
+			c.emit(code.OpGreaterThan)
+		case "<":
+			c.emit(code.OpLessThan)
+		case "==":
+			c.emit(code.OpEqual)
+		case "!=":
+			c.emit(code.OpNotEqual)
 		default:
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
 
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(integer))
+		c.emitConstant(c.addConstant(integer))
+
+	case *ast.Boolean:
+		if node.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+
+	case *ast.IfExpression:
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		// emit the jump with a bogus offset, it is back-patched once
+		// we know where the consequence ends
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		err = c.Compile(node.Consequence)
+		if err != nil {
+			return err
+		}
+
+		// if is an expression, the value of the block has to stay on the stack
+		c.keepBlockValue()
+
+		jumpPos := c.emit(code.OpJump, 9999)
+
+		afterConsequencePos := len(c.currentInstructions())
+		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+
+		// without an else branch, the if expression evaluates to null
+		if node.Alternative == nil {
+			c.emit(code.OpNull)
+		} else {
+			err := c.Compile(node.Alternative)
+			if err != nil {
+				return err
+			}
+
+			c.keepBlockValue()
+		}
+
+		afterAlternativePos := len(c.currentInstructions())
+		c.changeOperand(jumpPos, afterAlternativePos)
+
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			err := c.Compile(s)
+			if err != nil {
+				return err
+			}
+		}
+
+	case *ast.LetStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		symbol := c.symbolTable.Define(node.Name.Value)
+		if symbol.Scope == GlobalScope {
+			c.emit(code.OpSetGlobal, symbol.Index)
+		} else {
+			c.emit(code.OpSetLocal, symbol.Index)
+		}
+
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(node.Value)
+		if !ok {
+			return fmt.Errorf("identifier not found: %s", node.Value)
+		}
+
+		c.loadSymbol(symbol)
+
+	case *ast.StringLiteral:
+		str := &object.String{Value: node.Value}
+		c.emitConstant(c.addConstant(str))
+
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			err := c.Compile(el)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpArray, len(node.Elements))
+
+	case *ast.HashLiteral:
+		// the pairs are stored in a go map which has no stable iteration order,
+		// sort the keys so the emitted instructions are deterministic
+		keys := []ast.Expression{}
+		for k := range node.Pairs {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		for _, k := range keys {
+			err := c.Compile(k)
+			if err != nil {
+				return err
+			}
+
+			err = c.Compile(node.Pairs[k])
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpHash, len(node.Pairs)*2)
+
+	case *ast.IndexExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(node.Index)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpIndex)
+
+	case *ast.FunctionLiteral:
+		c.enterScope()
+
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+		}
+
+		// parameters are the first locals of the function, the VM
+		// finds the arguments in exactly these slots
+		for _, p := range node.Parameters {
+			c.symbolTable.Define(p.Value)
+		}
+
+		err := c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+
+		// the last expression of the body is returned implicitly
+		if c.lastInstructionIs(code.OpPop) {
+			c.replaceLastPopWithReturn()
+		}
+		// and a body without any value (empty or ending in a let) returns null
+		if !c.lastInstructionIs(code.OpReturnValue) {
+			c.emit(code.OpReturn)
+		}
+
+		freeSymbols := c.symbolTable.FreeSymbols
+		numLocals := c.symbolTable.numDefinitions
+		localNames := c.symbolTable.Names()
+		positions := c.scopes[c.scopeIndex].positions
+		instructions := c.leaveScope()
+
+		if c.optimize {
+			instructions, positions = code.Optimize(instructions, positions)
+		}
+
+		// push the captured values in the enclosing scope, OpClosure
+		// takes them off the stack into the closure it creates
+		for _, s := range freeSymbols {
+			c.loadSymbol(s)
+		}
+
+		compiledFn := &object.CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     numLocals,
+			NumParameters: len(node.Parameters),
+			Name:          node.Name,
+			Positions:     positions,
+			LocalNames:    localNames,
+		}
+		fnIndex := c.addConstant(compiledFn)
+		c.emitClosure(fnIndex, len(freeSymbols))
+
+	case *ast.ReturnStatement:
+		err := c.Compile(node.ReturnValue)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpReturnValue)
+
+	case *ast.CallExpression:
+		err := c.Compile(node.Function)
+		if err != nil {
+			return err
+		}
+
+		for _, a := range node.Arguments {
+			err := c.Compile(a)
+			if err != nil {
+				return err
+			}
+		}
+
+		// only the calls in function bodies are tail calls, the main program has no frame to reuse
+		if node.Tail && c.scopeIndex > 0 {
+			c.emit(code.OpTailCall, len(node.Arguments))
+		} else {
+			c.emit(code.OpCall, len(node.Arguments))
+		}
 	}
 
-	return nil
+	return c.operandErr
+}
+
+// loadSymbol emits the instruction which pushes the value bound to the symbol
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	}
 }
 
 // addConstant will add the constants to the Compiler constants
-// and return the index at which the constant was added
+// and return the index at which the constant was added. Integers and
+// strings are interned, an equal one which was added before is reused
 func (c *Compiler) addConstant(obj object.Object) int {
+	key, intern := internKey(obj)
+	if intern {
+		if index, ok := c.constantIndexes[key]; ok {
+			return index
+		}
+	}
+
 	c.constants = append(c.constants, obj)
-	return len(c.constants) - 1
+	index := len(c.constants) - 1
+
+	if intern {
+		c.constantIndexes[key] = index
+	}
+
+	return index
+}
+
+// internKey is the key an integer or string constant is interned under,
+// ok is false for the constants which are never shared
+func internKey(obj object.Object) (key constantKey, ok bool) {
+	switch obj := obj.(type) {
+	case *object.Integer, *object.String:
+		return constantKey{Type: obj.Type(), Value: obj.Inspect()}, true
+	default:
+		return constantKey{}, false
+	}
+}
+
+// emitConstant pushes the constant at index, the constants past
+// the reach of OpConstant's 2 byte operand use OpConstantWide
+func (c *Compiler) emitConstant(index int) int {
+	if index > math.MaxUint16 {
+		return c.emit(code.OpConstantWide, index)
+	}
+
+	return c.emit(code.OpConstant, index)
+}
+
+// emitClosure emits OpClosure, or OpClosureWide for a function constant
+// beyond the reach of OpClosure's 2 byte constant index
+func (c *Compiler) emitClosure(index, numFree int) int {
+	if index > math.MaxUint16 {
+		return c.emit(code.OpClosureWide, index, numFree)
+	}
+
+	return c.emit(code.OpClosure, index, numFree)
 }
 
 // emit constructs the byte array instruction, stores it into Compiler instructions
 // returns the starting index position of the just emitted instruction
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
+	c.checkOperands(op, operands...)
+
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
+
+	c.setLastInstruction(op, pos)
+
 	return pos
 }
 
+func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
+	previous := c.scopes[c.scopeIndex].lastInstruction
+	last := EmittedInstruction{Opcode: op, Position: pos}
+
+	c.scopes[c.scopeIndex].previousInstruction = previous
+	c.scopes[c.scopeIndex].lastInstruction = last
+}
+
+func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+
+	return c.scopes[c.scopeIndex].lastInstruction.Opcode == op
+}
+
+// keepBlockValue is called after compiling a block whose value is used. The trailing
+// OpPop of the block is removed, and a block which does not end in an expression
+// (empty or ending with a let statement) gets an OpNull so that it still produces a value
+func (c *Compiler) keepBlockValue() {
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+}
+
+// removeLastPop cuts off the last emitted OpPop, the previous
+// instruction then becomes the last one
+func (c *Compiler) removeLastPop() {
+	last := c.scopes[c.scopeIndex].lastInstruction
+	previous := c.scopes[c.scopeIndex].previousInstruction
+
+	c.scopes[c.scopeIndex].instructions = c.currentInstructions()[:last.Position]
+	c.scopes[c.scopeIndex].lastInstruction = previous
+
+	positions := c.scopes[c.scopeIndex].positions
+	for len(positions) > 0 && positions[len(positions)-1].Offset >= last.Position {
+		positions = positions[:len(positions)-1]
+	}
+	c.scopes[c.scopeIndex].positions = positions
+}
+
+// replaceLastPopWithReturn turns the trailing OpPop of a function body into an
+// OpReturnValue, both are one byte long so it can be replaced in place
+func (c *Compiler) replaceLastPopWithReturn() {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+
+	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
+}
+
+// replaceInstruction overwrites the instruction at pos with a new instruction,
+// the new instruction must be of the same length as the one it replaces
+func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
+	ins := c.currentInstructions()
+
+	for i := 0; i < len(newInstruction); i++ {
+		ins[pos+i] = newInstruction[i]
+	}
+}
+
+// changeOperand re-makes the instruction at pos with a new operand, used
+// to back-patch the offsets of jumps emitted before their target was known
+func (c *Compiler) changeOperand(opPos int, operand int) {
+	op := code.Opcode(c.currentInstructions()[opPos])
+	c.checkOperands(op, operand)
+	newInstruction := code.Make(op, operand)
+
+	c.replaceInstruction(opPos, newInstruction)
+}
+
+// checkOperands keeps the first operand which code.Make would truncate,
+// for instance too many locals or a jump too far for its 2 byte offset
+func (c *Compiler) checkOperands(op code.Opcode, operands ...int) {
+	if c.operandErr != nil {
+		return
+	}
+
+	if err := code.CheckOperands(op, operands...); err != nil {
+		c.operandErr = fmt.Errorf("can not compile: %s", err)
+	}
+}
+
 func (c *Compiler) addInstruction(ins []byte) int {
-	posNewInstruction := len(c.instructions)
-	c.instructions = append(c.instructions, ins...)
+	posNewInstruction := len(c.currentInstructions())
+	updatedInstructions := append(c.currentInstructions(), ins...)
+
+	c.scopes[c.scopeIndex].instructions = updatedInstructions
+	c.addPosition(posNewInstruction)
+
 	return posNewInstruction
 }
 
+// addPosition maps the instruction at pos to the position of the node being compiled,
+// an entry is only added when the position differs from the one of the previous entry
+func (c *Compiler) addPosition(pos int) {
+	positions := c.scopes[c.scopeIndex].positions
+	if !c.position.IsValid() {
+		return
+	}
+
+	if len(positions) > 0 && positions[len(positions)-1].Position == c.position {
+		return
+	}
+
+	c.scopes[c.scopeIndex].positions = append(positions, code.PositionEntry{Offset: pos, Position: c.position})
+}
+
+// currentInstructions are the instructions of the scope being compiled
+func (c *Compiler) currentInstructions() code.Instructions {
+	return c.scopes[c.scopeIndex].instructions
+}
+
+// enterScope starts compiling into a fresh scope with its own
+// instructions and a symbol table enclosed by the current one
+func (c *Compiler) enterScope() {
+	scope := CompilationScope{
+		instructions:        code.Instructions{},
+		lastInstruction:     EmittedInstruction{},
+		previousInstruction: EmittedInstruction{},
+	}
+	c.scopes = append(c.scopes, scope)
+	c.scopeIndex++
+
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
+}
+
+// leaveScope returns the instructions of the innermost scope and
+// continues compiling into the enclosing scope
+func (c *Compiler) leaveScope() code.Instructions {
+	instructions := c.currentInstructions()
+
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+
+	c.symbolTable = c.symbolTable.Outer
+
+	return instructions
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
+	instructions := c.currentInstructions()
+	positions := c.scopes[c.scopeIndex].positions
+
+	if c.optimize {
+		instructions, positions = code.Optimize(instructions, positions)
+	}
+
 	return &Bytecode{
-		Instructions: c.instructions,
+		Instructions: instructions,
 		Constants:    c.constants,
+		Positions:    positions,
+		GlobalNames:  c.symbolTable.Names(),
+	}
+}
+
+// Disassemble prints the bytecode with code.Disassemble, string constants are
+// quoted and compiled functions are described by their parameters and locals
+func (b *Bytecode) Disassemble() (string, error) {
+	return code.Disassemble(b.Instructions, DisassemblyConstants(b.Constants))
+}
+
+// DisassemblyConstants describes the constants for code.Disassemble
+func DisassemblyConstants(objects []object.Object) []code.Constant {
+	constants := make([]code.Constant, len(objects))
+
+	for i, constant := range objects {
+		switch constant := constant.(type) {
+		case *object.String:
+			constants[i] = code.Constant{Value: fmt.Sprintf("%q", constant.Value)}
+		case *object.CompiledFunction:
+			name := ""
+			if constant.Name != "" {
+				name = " " + constant.Name
+			}
+
+			constants[i] = code.Constant{
+				Value:        fmt.Sprintf("fn%s(params=%d, locals=%d)", name, constant.NumParameters, constant.NumLocals),
+				Instructions: constant.Instructions,
+			}
+		default:
+			constants[i] = code.Constant{Value: constant.Inspect()}
+		}
 	}
+
+	return constants
 }
@@ -0,0 +1,149 @@
+package compiler
+
+type SymbolScope string
+
+const (
+	GlobalScope  SymbolScope = "GLOBAL"
+	LocalScope   SymbolScope = "LOCAL"
+	BuiltinScope SymbolScope = "BUILTIN"
+	// FreeScope symbols are locals of an enclosing function captured by a closure
+	FreeScope SymbolScope = "FREE"
+	// FunctionScope is the symbol of the function itself, so it can call itself
+	FunctionScope SymbolScope = "FUNCTION"
+)
+
+// Symbol holds everything the compiler needs to know about an identifier,
+// its name, the scope it was defined in and its index in that scope
+type Symbol struct {
+	Name  string
+	Scope SymbolScope
+	Index int
+}
+
+// SymbolTable associates identifiers with symbols, each newly defined
+// identifier gets the next free index which the VM uses to store its value.
+// A function body gets its own symbol table enclosing the outer one, the same
+// way object.Environment encloses the outer environment in the evaluator
+type SymbolTable struct {
+	Outer *SymbolTable
+
+	store          map[string]Symbol
+	numDefinitions int
+
+	// FreeSymbols are the original symbols from the enclosing scopes which
+	// this function captures, in the order of their FreeScope indexes
+	FreeSymbols []Symbol
+}
+
+func NewSymbolTable() *SymbolTable {
+	s := make(map[string]Symbol)
+	return &SymbolTable{store: s}
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+	return s
+}
+
+// Copy returns a table with the same symbols which can be defined into without
+// changing this one, the enclosing tables are shared and not copied
+func (s *SymbolTable) Copy() *SymbolTable {
+	store := make(map[string]Symbol, len(s.store))
+	for name, symbol := range s.store {
+		store[name] = symbol
+	}
+
+	return &SymbolTable{
+		Outer:          s.Outer,
+		store:          store,
+		numDefinitions: s.numDefinitions,
+		FreeSymbols:    append([]Symbol(nil), s.FreeSymbols...),
+	}
+}
+
+// Define creates a symbol for the identifier and returns it, the symbol is
+// global in the outermost table and local in any enclosed table. Defining a
+// name again in the same table reuses its slot, so the new value replaces
+// the old one for every function referring to it, like Environment.Set does
+func (s *SymbolTable) Define(name string) Symbol {
+	scope := LocalScope
+	if s.Outer == nil {
+		scope = GlobalScope
+	}
+
+	if existing, ok := s.store[name]; ok && existing.Scope == scope {
+		return existing
+	}
+
+	symbol := Symbol{Name: name, Index: s.numDefinitions, Scope: scope}
+	s.store[name] = symbol
+	s.numDefinitions++
+	return symbol
+}
+
+// Names are the names of the bindings defined in this table indexed by their
+// slot, the VM reports them instead of the slot of a binding which is not set
+func (s *SymbolTable) Names() []string {
+	scope := LocalScope
+	if s.Outer == nil {
+		scope = GlobalScope
+	}
+
+	names := make([]string, s.numDefinitions)
+	for name, symbol := range s.store {
+		if symbol.Scope == scope {
+			names[symbol.Index] = name
+		}
+	}
+
+	return names
+}
+
+// Resolve looks up an identifier which was defined earlier, walking the enclosing
+// tables outwards when it is not found in this one. A local of an enclosing function
+// is turned into a free symbol of this table, since the closure has to capture it
+func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	obj, ok := s.store[name]
+	if !ok && s.Outer != nil {
+		obj, ok = s.Outer.Resolve(name)
+		if !ok {
+			return obj, ok
+		}
+
+		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+			return obj, ok
+		}
+
+		free := s.defineFree(obj)
+		return free, true
+	}
+
+	return obj, ok
+}
+
+// DefineBuiltin creates a symbol for the builtin at index of object.Builtins,
+// it does not take up a binding slot since builtins are not stored by the VM
+func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+// DefineFunctionName creates the symbol a function uses to refer to itself,
+// defining any other binding with the same name shadows it
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1}
+	symbol.Scope = FreeScope
+
+	s.store[original.Name] = symbol
+	return symbol
+}
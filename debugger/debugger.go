@@ -0,0 +1,345 @@
+// Package debugger is the interactive step debugger behind `ode debug`. It drives the
+// VM through the vm.Debugger hook, stopping at breakpoints on source lines or
+// instruction offsets, single-stepping instructions and stepping over calls, and
+// shows the operand stack, the locals, the globals and the current instruction
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/object"
+	"lookageek.com/ode/token"
+	"lookageek.com/ode/vm"
+)
+
+const PROMPT = "(ode) "
+
+const help = `commands:
+	step, s                  execute the next instruction
+	next, n                  execute the next instruction, calls run until they return
+	continue, c              run until the next breakpoint
+	break, b <breakpoint>    stop at <line>, at @<offset> of the main program or at <function>@<offset>
+	delete, d <breakpoint>   remove a breakpoint
+	breakpoints              list the breakpoints
+	where, w                 show the current instruction
+	backtrace, bt            show the call stack
+	stack                    show the operand stack of the current function
+	locals                   show the locals of the current function
+	globals                  show the globals which are set
+	quit, q                  stop the program
+an empty line repeats the previous command
+`
+
+// errQuit stops the VM when the program is quit
+var errQuit = errors.New("quit")
+
+// mode is how the execution continues after a command resumed it
+type mode int
+
+const (
+	stepping mode = iota
+	steppingOver
+	continuing
+)
+
+// offsetBreakpoint stops at the instruction at offset in the named function
+type offsetBreakpoint struct {
+	function string
+	offset   int
+}
+
+// Session is a debugging session of a single program, it is the vm.Debugger of the VM
+type Session struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+	file    string
+
+	lines   map[int]bool
+	offsets map[offsetBreakpoint]bool
+
+	mode mode
+	// overDepth is the depth of the frame stack when next was given,
+	// stepping over stops once the execution is back at that depth
+	overDepth int
+
+	// frameLines are the lines of the previously executed instruction of every
+	// frame, a line breakpoint only stops when its frame enters the line.
+	// lastDepth is the depth of the previously executed instruction
+	frameLines []int
+	lastDepth  int
+
+	lastCommand string
+	quit        bool
+}
+
+// Start runs the bytecode under the debugger, reading the commands from in. The
+// execution stops before the first instruction so breakpoints can be set
+func Start(in io.Reader, out io.Writer, bytecode *compiler.Bytecode) {
+	s := &Session{
+		scanner: bufio.NewScanner(in),
+		out:     out,
+		file:    bytecode.File,
+		lines:   make(map[int]bool),
+		offsets: make(map[offsetBreakpoint]bool),
+		mode:    stepping,
+	}
+
+	machine := vm.New(bytecode)
+	machine.SetDebugger(s)
+	err := machine.Run()
+
+	switch {
+	case s.quit:
+		return
+	case err != nil:
+		fmt.Fprintf(out, "program failed: %s\n", err)
+		if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+			io.WriteString(out, runtimeErr.StackTrace())
+		}
+	default:
+		fmt.Fprintf(out, "program finished: %s\n", inspect(machine.LastPoppedStackElem()))
+	}
+}
+
+// Step stops the execution when the instruction is to be stepped to or has a
+// breakpoint, then reads commands until one of them resumes the execution
+func (s *Session) Step(machine *vm.VM) error {
+	depth, line := machine.Depth(), machine.Position().Line
+
+	for len(s.frameLines) < depth {
+		s.frameLines = append(s.frameLines, 0)
+	}
+	// a call starts out on no line at all
+	if depth > s.lastDepth {
+		s.frameLines[depth-1] = 0
+	}
+
+	enteredLine := s.frameLines[depth-1] != line
+	s.frameLines[depth-1], s.lastDepth = line, depth
+
+	if !s.shouldStop(machine, enteredLine) {
+		return nil
+	}
+
+	s.where(machine)
+
+	for {
+		io.WriteString(s.out, PROMPT)
+		if !s.scanner.Scan() {
+			s.quit = true
+			return errQuit
+		}
+
+		command := strings.TrimSpace(s.scanner.Text())
+		if command == "" {
+			command = s.lastCommand
+		}
+		s.lastCommand = command
+
+		resume, err := s.execute(machine, command)
+		if err != nil {
+			fmt.Fprintf(s.out, "%s\n", err)
+			continue
+		}
+
+		if s.quit {
+			return errQuit
+		}
+
+		if resume {
+			return nil
+		}
+	}
+}
+
+func (s *Session) shouldStop(machine *vm.VM, enteredLine bool) bool {
+	switch s.mode {
+	case stepping:
+		return true
+	case steppingOver:
+		if machine.Depth() <= s.overDepth {
+			return true
+		}
+	}
+
+	if s.offsets[offsetBreakpoint{machine.Function(), machine.Offset()}] {
+		return true
+	}
+
+	return enteredLine && s.lines[machine.Position().Line]
+}
+
+// execute runs a single command, resume is true for the commands which continue the execution
+func (s *Session) execute(machine *vm.VM, command string) (resume bool, err error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false, nil
+	}
+
+	name, args := fields[0], fields[1:]
+
+	switch name {
+	case "step", "s":
+		s.mode = stepping
+		return true, nil
+
+	case "next", "n":
+		s.mode = steppingOver
+		s.overDepth = machine.Depth()
+		return true, nil
+
+	case "continue", "c":
+		s.mode = continuing
+		return true, nil
+
+	case "break", "b":
+		return false, s.setBreakpoint(args, true)
+
+	case "delete", "d":
+		return false, s.setBreakpoint(args, false)
+
+	case "breakpoints":
+		s.listBreakpoints()
+
+	case "where", "w":
+		s.where(machine)
+
+	case "backtrace", "bt":
+		for _, frame := range machine.CallStack() {
+			fmt.Fprintf(s.out, "\tat %s\n", s.locate(frame.Function, frame.Position))
+		}
+
+	case "stack":
+		s.printValues(machine.Stack(), "the stack is empty")
+
+	case "locals":
+		s.printValues(machine.Locals(), "no locals")
+
+	case "globals":
+		s.printValues(machine.Globals(), "no globals are set")
+
+	case "quit", "q":
+		s.quit = true
+
+	case "help", "h":
+		io.WriteString(s.out, help)
+
+	default:
+		return false, fmt.Errorf("unknown command %q, help lists the commands", name)
+	}
+
+	return false, nil
+}
+
+// setBreakpoint parses the breakpoint, a line number, @offset or function@offset
+func (s *Session) setBreakpoint(args []string, set bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a breakpoint: <line>, @<offset> or <function>@<offset>")
+	}
+
+	spec := args[0]
+	at := strings.LastIndex(spec, "@")
+
+	if at < 0 {
+		line, err := strconv.Atoi(spec)
+		if err != nil || line < 1 {
+			return fmt.Errorf("invalid line %q", spec)
+		}
+
+		if set {
+			s.lines[line] = true
+		} else {
+			delete(s.lines, line)
+		}
+		return nil
+	}
+
+	offset, err := strconv.Atoi(spec[at+1:])
+	if err != nil || offset < 0 {
+		return fmt.Errorf("invalid offset %q", spec[at+1:])
+	}
+
+	function := spec[:at]
+	if function == "" {
+		function = "<main>"
+	}
+
+	breakpoint := offsetBreakpoint{function: function, offset: offset}
+	if set {
+		s.offsets[breakpoint] = true
+	} else {
+		delete(s.offsets, breakpoint)
+	}
+
+	return nil
+}
+
+func (s *Session) listBreakpoints() {
+	if len(s.lines) == 0 && len(s.offsets) == 0 {
+		fmt.Fprintf(s.out, "no breakpoints\n")
+		return
+	}
+
+	listed := []string{}
+	for line := range s.lines {
+		listed = append(listed, fmt.Sprintf("line %d", line))
+	}
+	for breakpoint := range s.offsets {
+		listed = append(listed, fmt.Sprintf("%s@%04d", breakpoint.function, breakpoint.offset))
+	}
+
+	sort.Strings(listed)
+	for _, breakpoint := range listed {
+		fmt.Fprintf(s.out, "\t%s\n", breakpoint)
+	}
+}
+
+// where shows the function and the source position of the current instruction, and the instruction
+func (s *Session) where(machine *vm.VM) {
+	fmt.Fprintf(s.out, "%s\n", s.locate(machine.Function(), machine.Position()))
+	fmt.Fprintf(s.out, "\t%s\n", machine.Instruction())
+}
+
+func (s *Session) locate(function string, position token.Position) string {
+	switch {
+	case !position.IsValid():
+		return function
+	case s.file == "":
+		return fmt.Sprintf("%s (%d:%d)", function, position.Line, position.Column)
+	default:
+		return fmt.Sprintf("%s (%s:%d:%d)", function, s.file, position.Line, position.Column)
+	}
+}
+
+// printValues lists the values with their index, the unset ones are left out
+func (s *Session) printValues(values []object.Object, none string) {
+	printed := 0
+
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+
+		fmt.Fprintf(s.out, "\t%d: %s\n", i, inspect(value))
+		printed++
+	}
+
+	if printed == 0 {
+		fmt.Fprintf(s.out, "%s\n", none)
+	}
+}
+
+func inspect(obj object.Object) string {
+	if obj == nil {
+		return "nothing"
+	}
+
+	return obj.Inspect()
+}
@@ -0,0 +1,177 @@
+package debugger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/lexer"
+	"lookageek.com/ode/parser"
+)
+
+const program = `let add = fn(a, b) {
+  a + b
+};
+let x = add(1, 2);
+x * 2`
+
+// the main program of program is
+//   0000 OpClosure 0 0
+//   0004 OpSetGlobal 0
+//   0007 OpGetGlobal 0
+//   0010 OpConstant 1
+//   0013 OpConstant 2
+//   0016 OpCall 2
+//   0018 OpSetGlobal 1
+//   0021 OpGetGlobal 1
+//   0024 OpConstant 2
+//   0027 OpMul
+//   0028 OpPop
+// and add is
+//   0000 OpGetLocal 0
+//   0002 OpGetLocal 1
+//   0004 OpAdd
+//   0005 OpReturnValue
+
+func TestSession(t *testing.T) {
+	commands := `b 2
+c
+locals
+n
+
+stack
+c
+`
+
+	expected := `<main> (main.ode:1:11)
+	0000 OpClosure 0 0            ; fn add(params=2, locals=2)
+(ode) (ode) add (main.ode:2:3)
+	0000 OpGetLocal 0
+(ode) 	0: 1
+	1: 2
+(ode) add (main.ode:2:7)
+	0002 OpGetLocal 1
+(ode) add (main.ode:2:5)
+	0004 OpAdd
+(ode) 	0: 1
+	1: 2
+(ode) program finished: 6
+`
+
+	if out := debug(t, program, commands); out != expected {
+		t.Errorf("wrong session.\nwant = %q\ngot  = %q", expected, out)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands string
+		expected []string
+	}{
+		{
+			"offset breakpoint in a function",
+			"b add@4\nc\nstack\nbt\nq\n",
+			[]string{
+				"add (main.ode:2:5)\n\t0004 OpAdd\n",
+				"(ode) \t0: 1\n\t1: 2\n",
+				"(ode) \tat add (main.ode:2:5)\n\tat <main> (main.ode:4:12)\n",
+			},
+		},
+		{
+			"next steps over a call",
+			"b @16\nc\nn\nstack\nq\n",
+			[]string{
+				"<main> (main.ode:4:12)\n\t0016 OpCall 2\n",
+				"<main> (main.ode:4:1)\n\t0018 OpSetGlobal 1\n(ode) \t0: 3\n",
+			},
+		},
+		{
+			"step steps into a call",
+			"b @16\nc\ns\nw\nq\n",
+			[]string{"add (main.ode:2:3)\n\t0000 OpGetLocal 0\n(ode) add (main.ode:2:3)\n\t0000 OpGetLocal 0\n"},
+		},
+		{
+			"line breakpoints stop at the first instruction of the line",
+			"b 4\nc\nc\n",
+			[]string{"<main> (main.ode:4:9)\n\t0007 OpGetGlobal 0\n(ode) program finished: 6\n"},
+		},
+		{
+			"globals",
+			"b 5\nc\nglobals\nlocals\nq\n",
+			[]string{"\t1: 3\n(ode) no locals\n"},
+		},
+		{
+			"deleted breakpoints",
+			"b 2\nb @16\nbreakpoints\nd 2\nd @16\nbreakpoints\nc\n",
+			[]string{"(ode) \t<main>@0016\n\tline 2\n", "(ode) no breakpoints\n", "program finished: 6\n"},
+		},
+		{
+			"quitting",
+			"q\n",
+			[]string{"<main> (main.ode:1:11)\n\t0000 OpClosure 0 0            ; fn add(params=2, locals=2)\n(ode) "},
+		},
+		{
+			"bad commands",
+			"jump\nb x\nb @x\nb\nq\n",
+			[]string{
+				`unknown command "jump", help lists the commands`,
+				`invalid line "x"`,
+				`invalid offset "x"`,
+				"expected a breakpoint: <line>, @<offset> or <function>@<offset>",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		out := debug(t, program, tt.commands)
+
+		for _, expected := range tt.expected {
+			if !strings.Contains(out, expected) {
+				t.Errorf("%s: output is missing %q.\ngot = %q", tt.name, expected, out)
+			}
+		}
+
+		if strings.Contains(out, "program finished") != strings.HasSuffix(tt.commands, "c\n") {
+			t.Errorf("%s: the program has to finish unless it is quit.\ngot = %q", tt.name, out)
+		}
+	}
+}
+
+func TestFailingProgram(t *testing.T) {
+	out := debug(t, "let f = fn() { 1 + true };\nf();", "c\n")
+
+	expected := `(ode) program failed: main.ode:1:18: type mismatch: INTEGER + BOOLEAN
+	at f (main.ode:1:18)
+	at <main> (main.ode:2:2)
+`
+	if !strings.HasSuffix(out, expected) {
+		t.Errorf("wrong output.\nwant suffix = %q\ngot = %q", expected, out)
+	}
+}
+
+func debug(t *testing.T, input, commands string) string {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	comp := compiler.New()
+	comp.SetOptimizations(false)
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+	bytecode.File = "main.ode"
+
+	var out bytes.Buffer
+	Start(strings.NewReader(commands), &out, bytecode)
+
+	return out.String()
+}
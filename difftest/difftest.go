@@ -0,0 +1,154 @@
+// Package difftest runs ode programs on both execution engines, the tree-walking
+// evaluator and the compiler with the VM, and reports where the two disagree
+package difftest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"lookageek.com/ode/ast"
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/evaluator"
+	"lookageek.com/ode/lexer"
+	"lookageek.com/ode/object"
+	"lookageek.com/ode/parser"
+	"lookageek.com/ode/vm"
+)
+
+// Outcome is the result of running a program on one of the engines, the rendered
+// value of the last statement or the message of the error which stopped it
+type Outcome struct {
+	Value string
+	Err   string
+}
+
+func (o Outcome) String() string {
+	if o.Err != "" {
+		return "error: " + o.Err
+	}
+
+	return "value: " + o.Value
+}
+
+// Divergence describes a program for which the engines produced different outcomes
+type Divergence struct {
+	Program   string
+	Evaluator Outcome
+	VM        Outcome
+}
+
+func (d *Divergence) Error() string {
+	return fmt.Sprintf("engines diverge on %q\n\tevaluator: %s\n\tvm:        %s",
+		d.Program, d.Evaluator, d.VM)
+}
+
+// Compare runs the program on both engines and returns the divergence
+// between them, or nil when they agree
+func Compare(program *ast.Program) *Divergence {
+	evaluated := Evaluate(program)
+	executed := Execute(program)
+
+	if evaluated == executed {
+		return nil
+	}
+
+	return &Divergence{Program: program.String(), Evaluator: evaluated, VM: executed}
+}
+
+// CompareSource parses the input and compares it on both engines,
+// an error is returned if the input does not parse
+func CompareSource(input string) (*Divergence, error) {
+	l := lexer.New(input)
+	p := parser.New(l)
+
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parser errors: %s", strings.Join(p.Errors(), "; "))
+	}
+
+	return Compare(program), nil
+}
+
+// Evaluate runs the program on the tree-walking evaluator. A go panic is
+// recovered and reported as an error, so it can be compared as well
+func Evaluate(program *ast.Program) (outcome Outcome) {
+	defer func() {
+		if r := recover(); r != nil {
+			outcome = Outcome{Err: fmt.Sprintf("panic: %v", r)}
+		}
+	}()
+
+	result := evaluator.Eval(program, object.NewEnvironment())
+	if errObj, ok := result.(*object.Error); ok {
+		return Outcome{Err: errObj.Message}
+	}
+
+	return Outcome{Value: render(result)}
+}
+
+// Execute compiles the program, verifies the bytecode and runs it on the VM, compilation
+// errors are reported like runtime errors since the evaluator only finds them at runtime
+func Execute(program *ast.Program) (outcome Outcome) {
+	defer func() {
+		if r := recover(); r != nil {
+			outcome = Outcome{Err: fmt.Sprintf("panic: %v", r)}
+		}
+	}()
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		return Outcome{Err: err.Error()}
+	}
+
+	bytecode := comp.Bytecode()
+	compiled, err := vm.NewProgram(bytecode)
+	if err != nil {
+		return Outcome{Err: fmt.Sprintf("invalid bytecode: %s", err)}
+	}
+
+	machine := compiled.NewVM()
+	err = machine.Run()
+	if err != nil {
+		// the evaluator does not locate its errors, so only the messages are compared
+		if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+			return Outcome{Err: runtimeErr.Message}
+		}
+		return Outcome{Err: err.Error()}
+	}
+
+	return Outcome{Value: render(machine.LastPoppedStackElem())}
+}
+
+// render is Inspect for comparing values across engines. Functions are
+// represented differently by the engines, so all of them render as "fn"
+func render(obj object.Object) string {
+	switch obj := obj.(type) {
+	case nil:
+		return ""
+
+	case *object.Function, *object.Closure, *object.CompiledFunction:
+		return "fn"
+
+	case *object.Array:
+		elements := []string{}
+		for _, e := range obj.Elements {
+			elements = append(elements, render(e))
+		}
+
+		return "[" + strings.Join(elements, ", ") + "]"
+
+	case *object.Hash:
+		pairs := []string{}
+		for _, pair := range obj.Pairs {
+			pairs = append(pairs, render(pair.Key)+": "+render(pair.Value))
+		}
+		sort.Strings(pairs)
+
+		return "{" + strings.Join(pairs, ", ") + "}"
+
+	default:
+		return obj.Inspect()
+	}
+}
@@ -0,0 +1,247 @@
+package difftest
+
+import (
+	"flag"
+	"testing"
+)
+
+var programs = flag.Int("programs", 300, "number of random programs TestRandomPrograms compares")
+
+func TestCorpus(t *testing.T) {
+	corpus := []string{
+		// every input of the evaluator tests
+		"5",
+		"10",
+		"-5",
+		"-10",
+		"5 + 5 + 5 + 5 - 10",
+		"2 * 2 * 2 * 2 * 2",
+		"-50 + 100 + -50",
+		"5 * 2 + 10",
+		"5 + 2 * 10",
+		"20 + 2 * -10",
+		"50 / 2 * 2 + 10",
+		"2 * (5 + 10)",
+		"3 * 3 * 3 + 10",
+		"3 * (3 * 3) + 10",
+		"(5 + 10 * 2 + 15 / 3) * 2 + -10",
+		"true",
+		"false",
+		"1 < 2",
+		"1 > 2",
+		"1 < 1",
+		"1 > 1",
+		"1 == 1",
+		"1 != 1",
+		"1 == 2",
+		"1 != 2",
+		"true == true",
+		"false == false",
+		"true == false",
+		"true != false",
+		"false != true",
+		"(1 < 2) == true",
+		"(1 < 2) == false",
+		"(1 > 2) == true",
+		"(1 > 2) == false",
+		"!true",
+		"!false",
+		"!5",
+		"!!true",
+		"!!false",
+		"!!5",
+		"if (true) { 10 }",
+		"if (false) { 10 }",
+		"if (1) { 10 }",
+		"if (1 < 2) { 10 }",
+		"if (1 > 2) { 10 }",
+		"if (1 > 2) { 10 } else { 20 }",
+		"if (1 < 2) { 10 } else { 20 }",
+		"if (true) { }",
+		"if (true) { let a = 1; }",
+		"return 10;",
+		"return 10; 9;",
+		"return 2 * 5; 9;",
+		"9; return 2 * 5; 9;",
+		"if (10 > 1) { if (10 > 1) { return 10; } return 1; }",
+		"5 + true;",
+		"5 + true; 5;",
+		"-true",
+		"true + false;",
+		"5; true + false; 5",
+		"if (10 > 1) { true + false; }",
+		"if (10 > 1) { if (10 > 1) { return true + false; } return 1; }",
+		"foobar",
+		`"Hello" - "World"`,
+		"999[1]",
+		"fn(x) { x }();",
+		"fn() { 1 }(2);",
+		"let a = 5; a;",
+		"let a = 5 * 5; a;",
+		"let a = 5; let b = a; b;",
+		"let a = 5; let b = a; let c = a + b + 5; c;",
+		"fn(x) { x + 2; }",
+		"let identity = fn(x) { x; }; identity(5);",
+		"let identity = fn(x) { return x; }; identity(5);",
+		"let double = fn(x) { x * 2; }; double(5);",
+		"let add = fn(x, y) { x + y; }; add(5, 5);",
+		"let add = fn(x, y) { x + y; }; add(5 + 5, add(5, 5));",
+		"fn(x) { x; }(5)",
+		"let newAdder = fn(x) { fn(y) { x + y }; }; let addTwo = newAdder(2); addTwo(2);",
+		`"Hello World!"`,
+		`"Hello" + " " + "World!"`,
+		`len("")`,
+		`len("four")`,
+		`len("hello world")`,
+		"len(1)",
+		`len("one", "two")`,
+		"len([1, 2, 3])",
+		"len([])",
+		"first([1, 2, 3])",
+		"first([])",
+		"first(1)",
+		"last([1, 2, 3])",
+		"last([])",
+		"last(1)",
+		"rest([1, 2, 3])",
+		"rest([])",
+		"push([], 1)",
+		"push(1, 1)",
+		"[1, 2 * 2, 3 + 3]",
+		"[1, 2, 3][0]",
+		"[1, 2, 3][1]",
+		"[1, 2, 3][2]",
+		"let i = 0; [1][i];",
+		"[1, 2, 3][1 + 1];",
+		"let myArray = [1, 2, 3]; myArray[2];",
+		"let myArray = [1, 2, 3]; myArray[0] + myArray[1] + myArray[2];",
+		"let myArray = [1, 2, 3]; let i = myArray[0]; myArray[i]",
+		"[1, 2, 3][3]",
+		"[1, 2, 3][-1]",
+		`let two = "two"; {"one": 10 - 9, two: 1 + 1, "thr" + "ee": 6 / 2, 4: 4, true: 5, false: 6}`,
+		`{"foo": 5}["foo"]`,
+		`{"foo": 5}["bar"]`,
+		`{}["foo"]`,
+		"{5: 5}[5]",
+		"{true: 5}[true]",
+		"{false: 5}[false]",
+
+		// programs the evaluator tests do not cover
+		"if ((if (false) { 10 })) { 10 } else { 20 }",
+		"let a = 1; let a = a + 1; a;",
+		`"a" == "a"`,
+		"{[1]: 2}",
+		"fn() { }()",
+		"let noReturn = fn() { }; noReturn();",
+		"let f = fn() { let a = 1; }; f();",
+		"5()",
+		"1 / 0",
+		"let f = fn(x) { 10 / x }; f(0);",
+		"let newClosure = fn(a, b) { let c = a + b; fn(d) { let e = d + c; fn(f) { e + f; }; }; }; newClosure(1, 2)(3)(4);",
+		"let countDown = fn(x) { if (x == 0) { return 0; } else { countDown(x - 1); } }; countDown(10);",
+		"let fibonacci = fn(x) { if (x < 2) { return x; } fibonacci(x - 1) + fibonacci(x - 2); }; fibonacci(15);",
+		"let wrapper = fn() { let inner = fn(x) { if (x == 0) { return 2; } inner(x - 1); }; inner(1); }; wrapper();",
+		"let map = fn(arr, f) { let iter = fn(arr, acc) { if (len(arr) == 0) { acc } else { iter(rest(arr), push(acc, f(first(arr)))); } }; iter(arr, []); }; map([1, 2, 3], fn(x) { x * 2 });",
+		"let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + n) } }; loop(5000, 0);",
+		"let g = fn(a) { a }; let f = fn(x) { let y = x * 2; g(y + 1) }; f(3);",
+		"let f = fn(x) { if (x) { return len(x); } 0 }; f(\"abc\");",
+		"let f = fn() { g() }; f();",
+		"1 < true",
+		`"a" < "b"`,
+		"let f = fn(x) { x }; f(1) < f(true)",
+		"let f = fn() { let x = if (true) { return 1 }; 2 }; f()",
+		"let f = fn() { 1 + if (true) { return 2 } }; f() + 10",
+		"let x = if (true) { return 1 }; 2",
+		"[1, if (true) { return 5 }, 3]; 7",
+		"if (true) { let a = 1 }; a",
+		"let f = fn() { if (true) { let a = 1 }; a }; f()",
+		"if (false) { let a = 1 }; 2",
+		"let a = 1; let f = fn() { a }; let a = 2; f()",
+	}
+
+	for _, input := range corpus {
+		divergence, err := CompareSource(input)
+		if err != nil {
+			t.Fatalf("%q: %s", input, err)
+		}
+
+		if divergence != nil {
+			t.Error(divergence)
+		}
+	}
+}
+
+// TestKnownDivergences holds the programs on which the engines differ by design, the
+// generator does not generate them. A divergence which is gone shows up as a failure
+func TestKnownDivergences(t *testing.T) {
+	tests := []struct {
+		input     string
+		evaluator Outcome
+		vm        Outcome
+	}{
+		// functions are FUNCTION objects in the evaluator and CLOSURE objects in the VM
+		{
+			`{"name": "Ode"}[fn(x) { x }]`,
+			Outcome{Err: "unusable value as hash key: FUNCTION"},
+			Outcome{Err: "unusable value as hash key: CLOSURE"},
+		},
+		{
+			"-fn() { 1 }",
+			Outcome{Err: "unknown operator: -FUNCTION"},
+			Outcome{Err: "unknown operator: -CLOSURE"},
+		},
+		// a name bound in a branch which was not taken is unknown to the evaluator,
+		// the compiler resolves it and the VM finds it unset
+		{
+			"if (false) { let a = 1 }; a",
+			Outcome{Err: "identifier not found: a"},
+			Outcome{Err: "a is used before it is set"},
+		},
+		{
+			"let f = fn() { if (false) { let a = 1 }; a + 1 }; f()",
+			Outcome{Err: "identifier not found: a"},
+			Outcome{Err: "a is used before it is set"},
+		},
+		// a closure in the VM captures the values of the locals it references when it
+		// is created, a function in the evaluator sees locals rebound later on
+		{
+			"let f = fn(a) { let g = fn() { a }; let a = 2; g() }; f(1)",
+			Outcome{Value: "2"},
+			Outcome{Value: "1"},
+		},
+		// the evaluator checks a hash key right after evaluating it, the VM
+		// evaluates all keys and values before checking the keys
+		{
+			"{[1]: 1 + true}",
+			Outcome{Err: "unusable value as hash key: ARRAY"},
+			Outcome{Err: "type mismatch: INTEGER + BOOLEAN"},
+		},
+	}
+
+	for _, tt := range tests {
+		divergence, err := CompareSource(tt.input)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.input, err)
+		}
+
+		if divergence == nil {
+			t.Errorf("%q: the engines no longer diverge", tt.input)
+			continue
+		}
+
+		if divergence.Evaluator != tt.evaluator || divergence.VM != tt.vm {
+			t.Errorf("%q: the engines diverge differently\n\tevaluator: %s\n\tvm:        %s",
+				tt.input, divergence.Evaluator, divergence.VM)
+		}
+	}
+}
+
+func TestRandomPrograms(t *testing.T) {
+	for seed := int64(0); seed < int64(*programs); seed++ {
+		program := NewGenerator(seed).Program()
+
+		if divergence := Compare(program); divergence != nil {
+			t.Errorf("seed %d: %s", seed, divergence)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package difftest
+
+import (
+	"fmt"
+	"math/rand"
+
+	"lookageek.com/ode/ast"
+	"lookageek.com/ode/token"
+)
+
+// infixOperators are the operators the generator builds infix expressions with
+var infixOperators = []string{"+", "-", "*", "/", "==", "!=", ">", "<"}
+
+var infixTokenTypes = map[string]token.TokenType{
+	"+":  token.PLUS,
+	"-":  token.MINUS,
+	"*":  token.MULTIPLY,
+	"/":  token.DIVIDE,
+	"==": token.EQ,
+	"!=": token.NOTEQ,
+	">":  token.GREATERTHAN,
+	"<":  token.LESSTHAN,
+}
+
+// builtinNames are the builtins the generator calls, puts is left
+// out because it writes to stdout
+var builtinNames = []string{"len", "first", "last", "rest", "push"}
+
+var stringValues = []string{"", "a", "ode", "hello world"}
+
+// Generator builds random ode programs directly out of ast nodes. The programs use
+// every expression both engines support, and type errors are generated on purpose.
+// Only the programs on which the engines differ by design are avoided, each
+// restriction is explained where the generator applies it and the differences
+// are recorded as known divergences in the tests
+type Generator struct {
+	rand     *rand.Rand
+	maxDepth int
+
+	// scopes holds the names which can be referenced, innermost scope last
+	scopes [][]string
+	names  int
+}
+
+// NewGenerator creates a generator, the same seed always generates the same programs
+func NewGenerator(seed int64) *Generator {
+	return &Generator{
+		rand:     rand.New(rand.NewSource(seed)),
+		maxDepth: 4,
+		scopes:   [][]string{{}},
+	}
+}
+
+// Program generates a program of a few let statements followed by expression
+// statements, sometimes with a return statement in between
+func (g *Generator) Program() *ast.Program {
+	g.scopes = [][]string{{}}
+	program := &ast.Program{}
+
+	for i := g.rand.Intn(4); i > 0; i-- {
+		program.Statements = append(program.Statements, g.globalLetStatement())
+	}
+
+	for i := 1 + g.rand.Intn(2); i > 0; i-- {
+		if g.rand.Intn(8) == 0 {
+			program.Statements = append(program.Statements, g.returnStatement(0))
+		} else {
+			program.Statements = append(program.Statements, g.expressionStatement(0))
+		}
+	}
+
+	return program
+}
+
+func (g *Generator) expression(depth int) ast.Expression {
+	if depth >= g.maxDepth {
+		return g.leaf()
+	}
+
+	switch g.rand.Intn(12) {
+	case 0, 1:
+		return g.leaf()
+	case 2:
+		return g.prefixExpression(depth)
+	case 3, 4:
+		return g.infixExpression(depth)
+	case 5:
+		return g.ifExpression(depth)
+	case 6:
+		return g.arrayLiteral(depth)
+	case 7:
+		return g.hashLiteral()
+	case 8:
+		return g.indexExpression(depth)
+	case 9:
+		return g.functionCall(depth)
+	case 10:
+		return g.builtinCall(depth)
+	default:
+		return g.closureCall(depth)
+	}
+}
+
+// leaf generates an expression which can not fail, a literal or a bound name
+func (g *Generator) leaf() ast.Expression {
+	switch g.rand.Intn(5) {
+	case 0:
+		return g.integerLiteral()
+	case 1:
+		return boolean(g.rand.Intn(2) == 0)
+	case 2:
+		return stringLiteral(stringValues[g.rand.Intn(len(stringValues))])
+	default:
+		if names := g.visibleNames(); len(names) > 0 {
+			return identifier(names[g.rand.Intn(len(names))])
+		}
+		return g.integerLiteral()
+	}
+}
+
+func (g *Generator) integerLiteral() ast.Expression {
+	if g.rand.Intn(10) == 0 {
+		return integer(g.rand.Int63n(1 << 40))
+	}
+
+	return integer(int64(g.rand.Intn(10)))
+}
+
+func (g *Generator) prefixExpression(depth int) ast.Expression {
+	op := "!"
+	if g.rand.Intn(2) == 0 {
+		op = "-"
+	}
+
+	return prefix(op, g.expression(depth+1))
+}
+
+func (g *Generator) infixExpression(depth int) ast.Expression {
+	op := infixOperators[g.rand.Intn(len(infixOperators))]
+	return infix(g.expression(depth+1), op, g.expression(depth+1))
+}
+
+// ifExpression generates an if expression, its blocks can bind names and return
+func (g *Generator) ifExpression(depth int) ast.Expression {
+	ie := &ast.IfExpression{
+		Token:       token.Token{Type: token.IF, Literal: "if"},
+		Condition:   g.expression(depth + 1),
+		Consequence: g.ifBlock(depth + 1),
+	}
+
+	if g.rand.Intn(2) == 0 {
+		ie.Alternative = g.ifBlock(depth + 1)
+	}
+
+	return ie
+}
+
+// ifBlock holds let, return and expression statements. The names bound in the block are
+// only referenced in the block: after a branch which was not taken the names are unset,
+// and the engines report reading them differently, as an unknown identifier in the
+// evaluator and as an unset global or local in the VM
+func (g *Generator) ifBlock(depth int) *ast.BlockStatement {
+	g.pushScope()
+	defer g.popScope()
+
+	statements := []ast.Statement{}
+
+	for i := g.rand.Intn(3); i > 0; i-- {
+		switch g.rand.Intn(4) {
+		case 0:
+			statements = append(statements, g.letStatement(depth))
+		case 1:
+			statements = append(statements, g.returnStatement(depth))
+		default:
+			statements = append(statements, g.expressionStatement(depth))
+		}
+	}
+
+	return block(statements)
+}
+
+func (g *Generator) arrayLiteral(depth int) ast.Expression {
+	elements := []ast.Expression{}
+	for i := g.rand.Intn(4); i > 0; i-- {
+		elements = append(elements, g.expression(depth+1))
+	}
+
+	return &ast.ArrayLiteral{
+		Token:    token.Token{Type: token.LBRACKET, Literal: "["},
+		Elements: elements,
+	}
+}
+
+func (g *Generator) hashLiteral() ast.Expression {
+	pairs := make(map[ast.Expression]ast.Expression)
+
+	// the keys are distinct literals and the values are leaves, which cannot fail. The
+	// evaluator evaluates the pairs in go map order and checks each key before its value,
+	// the VM evaluates them all in the order of the keys and checks the keys afterwards.
+	// Every key kind is used at most once per hash, so the keys are always distinct
+	for i, kind := range g.rand.Perm(3)[:g.rand.Intn(4)] {
+		var key ast.Expression
+		switch kind {
+		case 0:
+			key = integer(int64(i))
+		case 1:
+			key = stringLiteral(stringValues[i])
+		default:
+			key = boolean(i%2 == 0)
+		}
+
+		pairs[key] = g.leaf()
+	}
+
+	return &ast.HashLiteral{
+		Token: token.Token{Type: token.LBRACE, Literal: "{"},
+		Pairs: pairs,
+	}
+}
+
+func (g *Generator) indexExpression(depth int) ast.Expression {
+	var index ast.Expression
+	if g.rand.Intn(2) == 0 {
+		index = integer(int64(g.rand.Intn(4) - 1))
+	} else {
+		index = g.expression(depth + 1)
+	}
+
+	return &ast.IndexExpression{
+		Token: token.Token{Type: token.LBRACKET, Literal: "["},
+		Left:  g.expression(depth + 1),
+		Index: index,
+	}
+}
+
+// functionCall calls a freshly generated function literal, usually
+// with the right number of arguments
+func (g *Generator) functionCall(depth int) ast.Expression {
+	fn := g.functionLiteral(depth+1, g.rand.Intn(3))
+
+	numArgs := len(fn.Parameters)
+	if g.rand.Intn(8) == 0 {
+		numArgs = g.rand.Intn(3)
+	}
+
+	return call(fn, g.arguments(depth+1, numArgs))
+}
+
+// closureCall returns an inner function out of an outer function and calls it,
+// the inner function references the parameters of the outer one
+func (g *Generator) closureCall(depth int) ast.Expression {
+	g.pushScope()
+	outerParam := g.freshName()
+	g.define(outerParam)
+
+	inner := g.functionLiteral(depth+1, 1)
+
+	g.popScope()
+
+	outer := &ast.FunctionLiteral{
+		Token:      token.Token{Type: token.FUNCTION, Literal: "fn"},
+		Parameters: []*ast.Identifier{identifier(outerParam)},
+		Body:       block([]ast.Statement{expressionStatement(inner)}),
+	}
+
+	returned := call(outer, g.arguments(depth+1, 1))
+	return call(returned, g.arguments(depth+1, 1))
+}
+
+func (g *Generator) functionLiteral(depth int, numParams int) *ast.FunctionLiteral {
+	g.pushScope()
+	defer g.popScope()
+
+	params := []*ast.Identifier{}
+	for i := 0; i < numParams; i++ {
+		name := g.freshName()
+		g.define(name)
+		params = append(params, identifier(name))
+	}
+
+	statements := []ast.Statement{}
+	for i := g.rand.Intn(3); i > 0; i-- {
+		statements = append(statements, g.letStatement(depth+1))
+	}
+	switch g.rand.Intn(6) {
+	case 0:
+	case 1, 2:
+		statements = append(statements, expressionStatement(g.ifExpression(depth+1)))
+	default:
+		statements = append(statements, g.expressionStatement(depth+1))
+	}
+
+	return &ast.FunctionLiteral{
+		Token:      token.Token{Type: token.FUNCTION, Literal: "fn"},
+		Parameters: params,
+		Body:       block(statements),
+	}
+}
+
+func (g *Generator) builtinCall(depth int) ast.Expression {
+	name := builtinNames[g.rand.Intn(len(builtinNames))]
+	return call(identifier(name), g.arguments(depth+1, g.rand.Intn(3)))
+}
+
+func (g *Generator) arguments(depth int, n int) []ast.Expression {
+	args := []ast.Expression{}
+	for i := 0; i < n; i++ {
+		args = append(args, g.expression(depth))
+	}
+
+	return args
+}
+
+// globalLetStatement binds a new name or rebinds a global. Only globals are rebound, a
+// closure in the VM captures the values of the locals it references when it is created
+// while a function in the evaluator sees the local rebound later on in its environment
+func (g *Generator) globalLetStatement() ast.Statement {
+	globals := g.scopes[0]
+	if len(globals) == 0 || g.rand.Intn(3) != 0 {
+		return g.letStatement(0)
+	}
+
+	return &ast.LetStatement{
+		Token: token.Token{Type: token.LET, Literal: "let"},
+		Name:  identifier(globals[g.rand.Intn(len(globals))]),
+		Value: g.expression(0),
+	}
+}
+
+// letStatement binds a new name, the name can only be referenced after the statement
+func (g *Generator) letStatement(depth int) ast.Statement {
+	value := g.expression(depth)
+	name := g.freshName()
+	g.define(name)
+
+	return &ast.LetStatement{
+		Token: token.Token{Type: token.LET, Literal: "let"},
+		Name:  identifier(name),
+		Value: value,
+	}
+}
+
+func (g *Generator) returnStatement(depth int) ast.Statement {
+	return &ast.ReturnStatement{
+		Token:       token.Token{Type: token.RETURN, Literal: "return"},
+		ReturnValue: g.expression(depth),
+	}
+}
+
+func (g *Generator) expressionStatement(depth int) ast.Statement {
+	return expressionStatement(g.expression(depth))
+}
+
+func (g *Generator) freshName() string {
+	g.names++
+	return fmt.Sprintf("v%d", g.names)
+}
+
+func (g *Generator) define(name string) {
+	g.scopes[len(g.scopes)-1] = append(g.scopes[len(g.scopes)-1], name)
+}
+
+func (g *Generator) visibleNames() []string {
+	names := []string{}
+	for _, scope := range g.scopes {
+		names = append(names, scope...)
+	}
+
+	return names
+}
+
+func (g *Generator) pushScope() {
+	g.scopes = append(g.scopes, []string{})
+}
+
+func (g *Generator) popScope() {
+	g.scopes = g.scopes[:len(g.scopes)-1]
+}
+
+// --- ast node constructors, the tokens are filled in so String() prints the nodes ---
+
+func integer(value int64) *ast.IntegerLiteral {
+	literal := fmt.Sprintf("%d", value)
+	return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: literal}, Value: value}
+}
+
+func boolean(value bool) *ast.Boolean {
+	if value {
+		return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "true"}, Value: true}
+	}
+
+	return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "false"}, Value: false}
+}
+
+func stringLiteral(value string) *ast.StringLiteral {
+	return &ast.StringLiteral{Token: token.Token{Type: token.STRING, Literal: value}, Value: value}
+}
+
+func identifier(name string) *ast.Identifier {
+	return &ast.Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}
+}
+
+func prefix(op string, right ast.Expression) ast.Expression {
+	tokenType := token.TokenType(token.NEGATION)
+	if op == "-" {
+		tokenType = token.MINUS
+	}
+
+	return &ast.PrefixExpression{
+		Token:    token.Token{Type: tokenType, Literal: op},
+		Operator: op,
+		Right:    right,
+	}
+}
+
+func infix(left ast.Expression, op string, right ast.Expression) ast.Expression {
+	return &ast.InfixExpression{
+		Token:    token.Token{Type: infixTokenTypes[op], Literal: op},
+		Left:     left,
+		Operator: op,
+		Right:    right,
+	}
+}
+
+func call(function ast.Expression, args []ast.Expression) ast.Expression {
+	return &ast.CallExpression{
+		Token:     token.Token{Type: token.LPAREN, Literal: "("},
+		Function:  function,
+		Arguments: args,
+	}
+}
+
+func block(statements []ast.Statement) *ast.BlockStatement {
+	return &ast.BlockStatement{
+		Token:      token.Token{Type: token.LBRACE, Literal: "{"},
+		Statements: statements,
+	}
+}
+
+func expressionStatement(e ast.Expression) ast.Statement {
+	return &ast.ExpressionStatement{Token: token.Token{Literal: e.TokenLiteral()}, Expression: e}
+}
@@ -1,77 +1,111 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
 
 	"lookageek.com/ode/ast"
+	"lookageek.com/ode/budget"
 	"lookageek.com/ode/object"
 )
 
-var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
-)
+// MaxDepth is how deep function calls can be nested unless the limits of the evaluation
+// say otherwise. Every nested call grows the Go stack, without a limit a deep
+// recursion would exhaust it and crash the process
+const MaxDepth = 10000
 
 // Eval function is the entry point to which the parsed AST node is passed
 // it walks the tree recursively and evaluated the nodes
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	return (&evaluation{maxDepth: MaxDepth}).eval(node, env)
+}
+
+// EvalContext is Eval which stops once ctx is done or a limit is exceeded, it
+// then returns an *object.Error whose Err wraps the error of the context or
+// the budget.ErrSteps, budget.ErrDepth or budget.ErrTime of the limit.
+// Every evaluated node is a step, a Depth of zero is MaxDepth
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment, limits budget.Limits) object.Object {
+	e := &evaluation{budget: budget.New(ctx, limits), maxDepth: MaxDepth}
+	if limits.Depth > 0 {
+		e.maxDepth = limits.Depth
+	}
+
+	return e.eval(node, env)
+}
+
+// evaluation is the state of a single evaluation
+type evaluation struct {
+	// budget is nil when the evaluation is not limited
+	budget *budget.Budget
+	// depth is the number of function calls being evaluated
+	depth    int
+	maxDepth int
+}
+
+func (e *evaluation) eval(node ast.Node, env *object.Environment) object.Object {
+	if e.budget != nil {
+		err := e.budget.Step()
+		if err != nil {
+			return &object.Error{Message: err.Error(), Err: err}
+		}
+	}
+
 	switch node := node.(type) {
 
 	case *ast.Program:
-		return evalProgram(node.Statements, env)
+		return e.evalProgram(node.Statements, env)
 
 	case *ast.ExpressionStatement:
-		return Eval(node.Expression, env)
+		return e.eval(node.Expression, env)
 
 	case *ast.IntegerLiteral:
-		return &object.Integer{Value: node.Value}
+		return object.NewInteger(node.Value)
 
 	case *ast.Boolean:
 		return nativeBooleanToBooleanObject(node.Value)
 
 	case *ast.PrefixExpression:
-		right := Eval(node.Right, env)
+		right := e.eval(node.Right, env)
 
-		if isError(right) {
+		if unwinds(right) {
 			return right
 		}
 
 		return evalPrefixExpression(node.Operator, right)
 
 	case *ast.InfixExpression:
-		left := Eval(node.Left, env)
+		left := e.eval(node.Left, env)
 
-		if isError(left) {
+		if unwinds(left) {
 			return left
 		}
 
-		right := Eval(node.Right, env)
+		right := e.eval(node.Right, env)
 
-		if isError(right) {
+		if unwinds(right) {
 			return right
 		}
 
 		return evalInfixExpression(node.Operator, left, right)
 
 	case *ast.BlockStatement:
-		return evalBlockStatement(node, env)
+		return e.evalBlockStatement(node, env)
 
 	case *ast.IfExpression:
-		return evalIfExpression(node, env)
+		return e.evalIfExpression(node, env)
 
 	case *ast.ReturnStatement:
-		val := Eval(node.ReturnValue, env)
+		val := e.eval(node.ReturnValue, env)
 
-		if isError(val) {
+		if unwinds(val) {
 			return val
 		}
 
 		return &object.ReturnValue{Value: val}
 
 	case *ast.LetStatement:
-		val := Eval(node.Value, env)
-		if isError(val) {
+		val := e.eval(node.Value, env)
+		if unwinds(val) {
 			return val
 		}
 		env.Set(node.Name.Value, val)
@@ -82,46 +116,51 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return &object.Function{Parameters: params, Env: env, Body: body, Name: node.Name}
 
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 
 	case *ast.CallExpression:
-		function := Eval(node.Function, env)
-		if isError(function) {
+		function := e.eval(node.Function, env)
+		if unwinds(function) {
 			return function
 		}
-		args := evalExpressions(node.Arguments, env)
+		args := e.evalExpressions(node.Arguments, env)
 
-		if len(args) == 1 && isError(args[0]) {
+		if len(args) == 1 && unwinds(args[0]) {
 			return args[0]
 		}
 
-		return applyFunction(function, args)
+		// the function making a tail call is done, applyFunction makes the call once it returns
+		if node.Tail && e.depth > 0 {
+			return &tailCall{fn: function, args: args}
+		}
+
+		return e.applyFunction(function, args)
 
 	case *ast.ArrayLiteral:
-		elements := evalExpressions(node.Elements, env)
-		if len(elements) == 1 && isError(elements[0]) {
+		elements := e.evalExpressions(node.Elements, env)
+		if len(elements) == 1 && unwinds(elements[0]) {
 			return elements[0]
 		}
 		return &object.Array{Elements: elements}
 
 	case *ast.IndexExpression:
-		left := Eval(node.Left, env)
-		if isError(left) {
+		left := e.eval(node.Left, env)
+		if unwinds(left) {
 			return left
 		}
 
-		index := Eval(node.Index, env)
-		if isError(index) {
+		index := e.eval(node.Index, env)
+		if unwinds(index) {
 			return index
 		}
 
 		return evalIndexExpression(left, index)
 
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		return e.evalHashLiteral(node, env)
 	}
 
 	return nil
@@ -131,29 +170,29 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 // it first evaluates the condition in the IfExpression and
 // if true evaluates the Consequence BlockStatement or else
 // evaluates the Alternative BlockStatement
-func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
-	condition := Eval(ie.Condition, env)
+func (e *evaluation) evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
+	condition := e.eval(ie.Condition, env)
 
-	if isError(condition) {
+	if unwinds(condition) {
 		return condition
 	}
 
 	if isTruthy(condition) {
-		return Eval(ie.Consequence, env)
+		return e.eval(ie.Consequence, env)
 	} else if ie.Alternative != nil {
-		return Eval(ie.Alternative, env)
+		return e.eval(ie.Alternative, env)
 	} else {
-		return NULL
+		return object.NULL
 	}
 }
 
 func isTruthy(obj object.Object) bool {
 	switch obj {
-	case NULL:
+	case object.NULL:
 		return false
-	case TRUE:
+	case object.TRUE:
 		return true
-	case FALSE:
+	case object.FALSE:
 		return false
 	default:
 		return true
@@ -162,11 +201,11 @@ func isTruthy(obj object.Object) bool {
 
 // evalProgram takes a slice of Statement nodes and evaluates them one
 // by one
-func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
+func (e *evaluation) evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, statement := range stmts {
-		result = Eval(statement, env)
+		result = e.eval(statement, env)
 
 		// if a return statement or an error is encountered,
 		//stop the evaluation of the program further on
@@ -183,11 +222,11 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 
 // evalBlockStatement evaluates the block statement having multiple statements surrounded
 // by curly braces
-func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
+func (e *evaluation) evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, statement := range block.Statements {
-		result = Eval(statement, env)
+		result = e.eval(statement, env)
 
 		if result != nil {
 			rt := result.Type()
@@ -198,16 +237,22 @@ func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) obje
 		}
 	}
 
+	// a block is used as a value by if expressions and function bodies,
+	// an empty block or one ending in a let statement evaluates to null
+	if result == nil {
+		return object.NULL
+	}
+
 	return result
 }
 
 // converts the literal boolean to a Boolean Object
 func nativeBooleanToBooleanObject(input bool) *object.Boolean {
 	if input {
-		return TRUE
+		return object.TRUE
 	}
 
-	return FALSE
+	return object.FALSE
 }
 
 // evalPrefixExpression evals a prefix expression which consists of ! or - expression
@@ -225,14 +270,14 @@ func evalPrefixExpression(operator string, right object.Object) object.Object {
 // evalBangOperatorExpression evaluates the "!" prefix operator expression
 func evalBangOperatorExpression(right object.Object) object.Object {
 	switch right {
-	case TRUE:
-		return FALSE
-	case FALSE:
-		return TRUE
-	case NULL:
-		return TRUE
+	case object.TRUE:
+		return object.FALSE
+	case object.FALSE:
+		return object.TRUE
+	case object.NULL:
+		return object.TRUE
 	default:
-		return FALSE
+		return object.FALSE
 	}
 }
 
@@ -243,7 +288,7 @@ func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
 	}
 
 	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+	return object.NewInteger(-value)
 }
 
 // evalInfixExpression evals normal math operators +, -, *, /
@@ -278,13 +323,16 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 
 	switch operator {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		return object.NewInteger(leftVal + rightVal)
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		return object.NewInteger(leftVal - rightVal)
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		return object.NewInteger(leftVal * rightVal)
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return object.NewInteger(leftVal / rightVal)
 	case "<":
 		return nativeBooleanToBooleanObject(leftVal < rightVal)
 	case ">":
@@ -309,7 +357,7 @@ func evalIdentifier(
 		return val
 	}
 
-	if builtin, ok := builtins[node.Value]; ok {
+	if builtin := object.GetBuiltinByName(node.Value); builtin != nil {
 		return builtin
 	}
 
@@ -318,15 +366,15 @@ func evalIdentifier(
 
 // evalExpressions evaluates all the arguments that are passed into a function
 // before evaluating the function itself
-func evalExpressions(
+func (e *evaluation) evalExpressions(
 	exps []ast.Expression,
 	env *object.Environment,
 ) []object.Object {
 	var result []object.Object
 
-	for _, e := range exps {
-		evaluated := Eval(e, env)
-		if isError(evaluated) {
+	for _, exp := range exps {
+		evaluated := e.eval(exp, env)
+		if unwinds(evaluated) {
 			return []object.Object{evaluated}
 		}
 
@@ -337,22 +385,73 @@ func evalExpressions(
 }
 
 // applyFunction takes a function object, uses the environment hierarchy and evaluates
-// the block statements inside function body
-func applyFunction(fn object.Object, args []object.Object) object.Object {
-	switch fn := fn.(type) {
-	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+// the block statements inside function body. A tail call in the body evaluates to a
+// tailCall, which is applied in place of the function so that tail recursion
+// does not grow the Go stack
+func (e *evaluation) applyFunction(fn object.Object, args []object.Object) object.Object {
+	for {
+		function, ok := fn.(*object.Function)
+		if !ok {
+			return applyBuiltin(fn, args)
+		}
 
-	case *object.Builtin:
-		return fn.Fn(args...)
+		if len(args) != len(function.Parameters) {
+			return newError("wrong number of arguments: want = %d, got = %d", len(function.Parameters), len(args))
+		}
 
-	default:
+		if e.depth >= e.maxDepth {
+			return &object.Error{
+				Message: fmt.Sprintf("maximum recursion depth exceeded in %s", functionName(function)),
+				Err:     budget.ErrDepth,
+			}
+		}
+
+		e.depth++
+		extendedEnv := extendFunctionEnv(function, args)
+		evaluated := unwrapReturnValue(e.eval(function.Body, extendedEnv))
+		e.depth--
+
+		call, ok := evaluated.(*tailCall)
+		if !ok {
+			return evaluated
+		}
+
+		fn, args = call.fn, call.args
+	}
+}
+
+// functionName is how errors refer to the function
+func functionName(fn *object.Function) string {
+	if fn.Name == "" {
+		return "<fn>"
+	}
+
+	return fn.Name
+}
+
+func applyBuiltin(fn object.Object, args []object.Object) object.Object {
+	builtin, ok := fn.(*object.Builtin)
+	if !ok {
 		return newError("not a function: %s", fn.Type())
 	}
+
+	// builtins without a value return nil, which is null in ode
+	if result := builtin.Fn(args...); result != nil {
+		return result
+	}
+	return object.NULL
 }
 
+// tailCall is the value of a call in tail position, it is passed up to applyFunction
+// which makes the call after the function making it returned
+type tailCall struct {
+	fn   object.Object
+	args []object.Object
+}
+
+func (tc *tailCall) Type() object.ObjectType { return "TAIL_CALL" }
+func (tc *tailCall) Inspect() string         { return "tail call" }
+
 // extendFunctionEnv constructs blank env with all the arguments to the function
 // then sets the outer env to the env passed into function object
 func extendFunctionEnv(
@@ -393,9 +492,13 @@ func newError(format string, a ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
 
-func isError(obj object.Object) bool {
+// unwinds tells whether the evaluation of the enclosing expression has to stop. An error
+// stops it, as does a return statement in a nested if expression, which returns
+// from the function right away just like a return in the VM does
+func unwinds(obj object.Object) bool {
 	if obj != nil {
-		return obj.Type() == object.ERROR_OBJ
+		rt := obj.Type()
+		return rt == object.ERROR_OBJ || rt == object.RETURN_VALUE_OBJ
 	}
 
 	return false
@@ -421,7 +524,7 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	max := int64(len(arrayObject.Elements) - 1)
 
 	if idx < 0 || idx > max {
-		return NULL
+		return object.NULL
 	}
 
 	return arrayObject.Elements[idx]
@@ -436,19 +539,19 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 
 	pair, ok := hashObject.Pairs[key.HashKey()]
 	if !ok {
-		return NULL
+		return object.NULL
 	}
 
 	return pair.Value
 }
 
 // evalHashLiteral evaluates the AST node of HashLiteral and creates the Hash internal object
-func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
+func (e *evaluation) evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
 	pairs := make(map[object.HashKey]object.HashPair)
 
 	for keyNode, valueNode := range node.Pairs {
-		key := Eval(keyNode, env)
-		if isError(key) {
+		key := e.eval(keyNode, env)
+		if unwinds(key) {
 			return key
 		}
 
@@ -457,8 +560,8 @@ func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Obje
 			return newError("unusable value as hash key: %s", key.Type())
 		}
 
-		value := Eval(valueNode, env)
-		if isError(value) {
+		value := e.eval(valueNode, env)
+		if unwinds(value) {
 			return value
 		}
 
@@ -1,8 +1,14 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"lookageek.com/ode/budget"
 	"lookageek.com/ode/lexer"
 	"lookageek.com/ode/object"
 	"lookageek.com/ode/parser"
@@ -139,6 +145,8 @@ func TestIfElseExpressions(t *testing.T) {
 		{"if (1 > 2) { 10 }", nil},
 		{"if (1 > 2) { 10 } else { 20 }", 20},
 		{"if (1 < 2) { 10 } else { 20 }", 10},
+		{"if (true) { }", nil},
+		{"if (true) { let a = 1; }", nil},
 	}
 
 	for _, tt := range tests {
@@ -154,7 +162,7 @@ func TestIfElseExpressions(t *testing.T) {
 }
 
 func testNullObject(t *testing.T, obj object.Object) bool {
-	if obj != NULL {
+	if obj != object.NULL {
 		t.Errorf("object is not NULL. got = %T (%+v)", obj, obj)
 		return false
 	}
@@ -171,6 +179,9 @@ func TestReturnStatements(t *testing.T) {
 		{"return 10; 9;", 10},
 		{"return 2 * 5; 9;", 10},
 		{"9; return 2 * 5; 9;", 10},
+		// a return in a nested expression returns from the function right away
+		{"let f = fn() { let x = if (true) { return 1 }; 2 }; f()", 1},
+		{"let f = fn() { 1 + if (true) { return 2 } }; f() + 10", 12},
 		{
 			`if (10 > 1) {
 	if (10 > 1) {
@@ -233,6 +244,9 @@ if (10 > 1) {
 		{`"Hello" - "World"`, "unknown operator: STRING - STRING"},
 		{"999[1]", "index operator not supported: INTEGER"},
 		{`{"name":"Monkey"}[fn(x) { x }];`, "unusable value as hash key: FUNCTION"},
+		{"fn(x) { x }();", "wrong number of arguments: want = 1, got = 0"},
+		{"fn() { 1 }(2);", "wrong number of arguments: want = 0, got = 1"},
+		{"1 / 0", "division by zero"},
 	}
 
 	for _, tt := range tests {
@@ -493,8 +507,8 @@ func TestHashLiterals(t *testing.T) {
 		(&object.String{Value: "two"}).HashKey():   2,
 		(&object.String{Value: "three"}).HashKey(): 3,
 		(&object.Integer{Value: 4}).HashKey():      4,
-		TRUE.HashKey():                             5,
-		FALSE.HashKey():                            6,
+		object.TRUE.HashKey():                      5,
+		object.FALSE.HashKey():                     6,
 	}
 
 	if len(result.Pairs) != len(expected) {
@@ -552,3 +566,142 @@ func TestHashIndexExpression(t *testing.T) {
 		}
 	}
 }
+
+func TestLimits(t *testing.T) {
+	// endless runs for about 2^40 calls without nesting them deeper than 40
+	endless := "let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) + f(n - 1) } }; f(40);"
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		input    string
+		ctx      context.Context
+		limits   budget.Limits
+		expected error
+	}{
+		{"steps", endless, context.Background(), budget.Limits{Steps: 1000}, budget.ErrSteps},
+		{"time", endless, context.Background(), budget.Limits{Time: 10 * time.Millisecond}, budget.ErrTime},
+		{"canceled context", endless, canceled, budget.Limits{}, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated := EvalContext(tt.ctx, program, object.NewEnvironment(), tt.limits)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%s: no error object returned. got = %T (%+v)", tt.name, evaluated, evaluated)
+			continue
+		}
+
+		if !errors.Is(errObj.Err, tt.expected) {
+			t.Errorf("%s: wrong error. want = %s, got = %v", tt.name, tt.expected, errObj.Err)
+		}
+
+		if errObj.Message != errObj.Err.Error() {
+			t.Errorf("%s: wrong message. want = %q, got = %q", tt.name, errObj.Err.Error(), errObj.Message)
+		}
+	}
+}
+
+func TestEvalContextWithinLimits(t *testing.T) {
+	program := parser.New(lexer.New("let f = fn(x) { x * 2 }; f(f(3))")).ParseProgram()
+	limits := budget.Limits{Steps: 100, Depth: 1, Time: time.Minute}
+
+	evaluated := EvalContext(context.Background(), program, object.NewEnvironment(), limits)
+	testIntegerObject(t, evaluated, 12)
+
+	// the errors of the program itself have no Go error
+	evaluated = EvalContext(context.Background(), parser.New(lexer.New("1 / 0")).ParseProgram(), object.NewEnvironment(), limits)
+	if errObj, ok := evaluated.(*object.Error); !ok || errObj.Err != nil {
+		t.Errorf("wrong error object. got = %+v", evaluated)
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + n) } }; loop(100000, 0);", 5000050000},
+		{"let loop = fn(n) { if (n == 0) { return 0; } return loop(n - 1); }; loop(100000);", 0},
+		{"let g = fn(a, b) { let c = a + b; c * 2 }; let f = fn(x) { g(x, 1) }; f(3);", 8},
+		{"let f = fn(a) { len(a) }; f([1, 2]) + 1;", 3},
+		{"let adder = fn(x) { fn(y) { x + y } }; let f = fn(x) { adder(x)(2) }; f(1);", 3},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+
+	// tail calls do not nest, the loop never is more than a call deep
+	program := parser.New(lexer.New(tests[0].input)).ParseProgram()
+	evaluated := EvalContext(context.Background(), program, object.NewEnvironment(), budget.Limits{Depth: 1})
+	testIntegerObject(t, evaluated, tests[0].expected)
+}
+
+func TestRecursionDepth(t *testing.T) {
+	tests := []struct {
+		input    string
+		depth    int
+		expected string
+	}{
+		{"let f = fn(x) { f(x) + 1 }; f(1);", 0, "maximum recursion depth exceeded in f"},
+		{"let f = fn(x) { f(x) + 1 }; f(1);", 100, "maximum recursion depth exceeded in f"},
+		{"fn(x) { x() + 1 }(fn() { 1 + 1 });", 1, "maximum recursion depth exceeded in <fn>"},
+		{"let f = fn(x) { if (x == 0) { 0 } else { 1 + f(x - 1) } }; f(100);", 100, "maximum recursion depth exceeded in f"},
+		// the calls which stay within the limit
+		{"let f = fn(x) { if (x == 0) { 0 } else { 1 + f(x - 1) } }; f(99);", 100, ""},
+		{"let f = fn(x) { if (x == 0) { 0 } else { 1 + f(x - 1) } }; f(MaxDepth - 1);", 0, ""},
+	}
+
+	for _, tt := range tests {
+		input := strings.Replace(tt.input, "MaxDepth", strconv.Itoa(MaxDepth), 1)
+		program := parser.New(lexer.New(input)).ParseProgram()
+		evaluated := EvalContext(context.Background(), program, object.NewEnvironment(), budget.Limits{Depth: tt.depth})
+
+		errObj, ok := evaluated.(*object.Error)
+		if tt.expected == "" {
+			if ok {
+				t.Errorf("%q: unexpected error: %s", input, errObj.Message)
+			}
+			continue
+		}
+
+		if !ok {
+			t.Errorf("%q: no error object returned. got = %T (%+v)", input, evaluated, evaluated)
+			continue
+		}
+
+		if errObj.Message != tt.expected {
+			t.Errorf("%q: wrong message. want = %q, got = %q", input, tt.expected, errObj.Message)
+		}
+
+		if !errors.Is(errObj.Err, budget.ErrDepth) {
+			t.Errorf("%q: wrong error. want = %s, got = %v", input, budget.ErrDepth, errObj.Err)
+		}
+	}
+
+	// Eval without limits stops at MaxDepth too, instead of running out of Go stack
+	evaluated := testEval("let f = fn(x) { f(x) + 1 }; f(1);")
+	if errObj, ok := evaluated.(*object.Error); !ok || errObj.Message != "maximum recursion depth exceeded in f" {
+		t.Errorf("wrong result of Eval. got = %+v", evaluated)
+	}
+}
+
+func BenchmarkFibonacci(b *testing.B) {
+	program := parser.New(lexer.New(`let fibonacci = fn(x) {
+		if (x < 2) { x } else { fibonacci(x - 1) + fibonacci(x - 2) }
+	};
+	fibonacci(20);`)).ParseProgram()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		evaluated := Eval(program, object.NewEnvironment())
+		if errObj, ok := evaluated.(*object.Error); ok {
+			b.Fatalf("evaluation error: %s", errObj.Message)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Package fold rewrites an ode program before it is evaluated or compiled. Operations
+// on integer, boolean and string literals are computed ahead of time and the dead
+// branch of an if expression with a literal condition is removed. Operations which
+// fail at runtime, like a division by zero or a type mismatch, are left alone
+// so they still fail when the program is executed
+package fold
+
+import (
+	"strconv"
+
+	"lookageek.com/ode/ast"
+	"lookageek.com/ode/token"
+)
+
+// Program folds the program in place, it is returned for convenience
+func Program(program *ast.Program) *ast.Program {
+	for i, s := range program.Statements {
+		program.Statements[i] = statement(s)
+	}
+
+	return program
+}
+
+func statement(s ast.Statement) ast.Statement {
+	switch s := s.(type) {
+	case *ast.LetStatement:
+		s.Value = expression(s.Value)
+	case *ast.ReturnStatement:
+		s.ReturnValue = expression(s.ReturnValue)
+	case *ast.ExpressionStatement:
+		s.Expression = expression(s.Expression)
+	case *ast.BlockStatement:
+		block(s)
+	}
+
+	return s
+}
+
+func block(b *ast.BlockStatement) {
+	if b == nil {
+		return
+	}
+
+	for i, s := range b.Statements {
+		b.Statements[i] = statement(s)
+	}
+}
+
+func expression(e ast.Expression) ast.Expression {
+	switch e := e.(type) {
+	case *ast.PrefixExpression:
+		e.Right = expression(e.Right)
+		return prefix(e)
+
+	case *ast.InfixExpression:
+		e.Left = expression(e.Left)
+		e.Right = expression(e.Right)
+		return infix(e)
+
+	case *ast.IfExpression:
+		e.Condition = expression(e.Condition)
+		block(e.Consequence)
+		block(e.Alternative)
+		return ifExpression(e)
+
+	case *ast.FunctionLiteral:
+		block(e.Body)
+
+	case *ast.CallExpression:
+		e.Function = expression(e.Function)
+		for i, a := range e.Arguments {
+			e.Arguments[i] = expression(a)
+		}
+
+	case *ast.ArrayLiteral:
+		for i, element := range e.Elements {
+			e.Elements[i] = expression(element)
+		}
+
+	case *ast.HashLiteral:
+		pairs := make(map[ast.Expression]ast.Expression)
+		for key, value := range e.Pairs {
+			pairs[expression(key)] = expression(value)
+		}
+		e.Pairs = pairs
+
+	case *ast.IndexExpression:
+		e.Left = expression(e.Left)
+		e.Index = expression(e.Index)
+	}
+
+	return e
+}
+
+func prefix(e *ast.PrefixExpression) ast.Expression {
+	switch e.Operator {
+	case "!":
+		if truthy, ok := literalTruthiness(e.Right); ok {
+			return boolean(e.Token, !truthy)
+		}
+
+	case "-":
+		if right, ok := e.Right.(*ast.IntegerLiteral); ok {
+			return integer(e.Token, -right.Value)
+		}
+	}
+
+	return e
+}
+
+func infix(e *ast.InfixExpression) ast.Expression {
+	switch left := e.Left.(type) {
+	case *ast.IntegerLiteral:
+		if right, ok := e.Right.(*ast.IntegerLiteral); ok {
+			return integerInfix(e, left.Value, right.Value)
+		}
+
+	case *ast.Boolean:
+		if right, ok := e.Right.(*ast.Boolean); ok {
+			return booleanInfix(e, left.Value, right.Value)
+		}
+
+	case *ast.StringLiteral:
+		if right, ok := e.Right.(*ast.StringLiteral); ok && e.Operator == "+" {
+			return str(e.Token, left.Value+right.Value)
+		}
+	}
+
+	return e
+}
+
+func integerInfix(e *ast.InfixExpression, left, right int64) ast.Expression {
+	switch e.Operator {
+	case "+":
+		return integer(e.Token, left+right)
+	case "-":
+		return integer(e.Token, left-right)
+	case "*":
+		return integer(e.Token, left*right)
+	case "/":
+		// dividing by zero has to fail at runtime
+		if right != 0 {
+			return integer(e.Token, left/right)
+		}
+	case "<":
+		return boolean(e.Token, left < right)
+	case ">":
+		return boolean(e.Token, left > right)
+	case "==":
+		return boolean(e.Token, left == right)
+	case "!=":
+		return boolean(e.Token, left != right)
+	}
+
+	return e
+}
+
+func booleanInfix(e *ast.InfixExpression, left, right bool) ast.Expression {
+	switch e.Operator {
+	case "==":
+		return boolean(e.Token, left == right)
+	case "!=":
+		return boolean(e.Token, left != right)
+	}
+
+	return e
+}
+
+// ifExpression removes the branch which is never taken when the condition is a literal.
+// A remaining branch made of a single expression replaces the whole if expression,
+// any other branch stays in an if expression whose condition is always true
+func ifExpression(e *ast.IfExpression) ast.Expression {
+	truthy, ok := literalTruthiness(e.Condition)
+	if !ok {
+		return e
+	}
+
+	taken := e.Consequence
+	if !truthy {
+		taken = e.Alternative
+	}
+
+	// a false condition without an alternative evaluates to null, an empty block does too
+	if taken == nil {
+		taken = &ast.BlockStatement{Token: e.Token}
+	}
+
+	if len(taken.Statements) == 1 {
+		if es, ok := taken.Statements[0].(*ast.ExpressionStatement); ok && es.Expression != nil {
+			return es.Expression
+		}
+	}
+
+	return &ast.IfExpression{
+		Token:       e.Token,
+		Condition:   boolean(e.Token, true),
+		Consequence: taken,
+	}
+}
+
+// literalTruthiness reports whether a literal is truthy, ok is false
+// when the expression is not a literal with a known truthiness
+func literalTruthiness(e ast.Expression) (truthy bool, ok bool) {
+	switch e := e.(type) {
+	case *ast.Boolean:
+		return e.Value, true
+	case *ast.IntegerLiteral, *ast.StringLiteral:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// the folded literals keep the position of the expression they replace
+
+func integer(at token.Token, value int64) *ast.IntegerLiteral {
+	literal := strconv.FormatInt(value, 10)
+	return &ast.IntegerLiteral{
+		Token: token.Token{Type: token.INT, Literal: literal, Position: at.Position},
+		Value: value,
+	}
+}
+
+func boolean(at token.Token, value bool) *ast.Boolean {
+	if value {
+		return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "true", Position: at.Position}, Value: true}
+	}
+
+	return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "false", Position: at.Position}, Value: false}
+}
+
+func str(at token.Token, value string) *ast.StringLiteral {
+	return &ast.StringLiteral{
+		Token: token.Token{Type: token.STRING, Literal: value, Position: at.Position},
+		Value: value,
+	}
+}
@@ -0,0 +1,96 @@
+package fold
+
+import (
+	"testing"
+
+	"lookageek.com/ode/ast"
+	"lookageek.com/ode/difftest"
+	"lookageek.com/ode/lexer"
+	"lookageek.com/ode/parser"
+)
+
+func TestFolding(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"2 * 60 * 60", "7200"},
+		{"1 + 2 * 3 - 4 / 2", "5"},
+		{"-(1 + 2)", "-3"},
+		{"--5", "5"},
+		{"1 < 2", "true"},
+		{"2 > 1 == false", "false"},
+		{"1 == 1 != true", "false"},
+		{"!true", "false"},
+		{"!!5", "true"},
+		{`!"ode"`, "false"},
+		{`"o" + "d" + "e"`, "ode"},
+		{"x + 1 * 2", "(x + 2)"},
+		{"let a = 1 + 1; a * (3 - 1)", "let a = 2;(a * 2)"},
+		{"fn(x) { return x * (60 * 60); }", "fn(x) return (x * 3600);"},
+		{"f(1 + 1, [2 * 2], {1 + 1: 3 - 3})[0 + 1]", "(f(2, [4], {2:0})[1])"},
+
+		// runtime errors are left for the engines
+		{"1 / 0", "(1 / 0)"},
+		{"1 + true", "(1 + true)"},
+		{"true + false", "(true + false)"},
+		{"-true", "(-true)"},
+		{`"a" - "b"`, "(a - b)"},
+		{`"a" == "a"`, "(a == a)"},
+
+		// dead branches
+		{"if (true) { a } else { b }", "a"},
+		{"if (false) { a } else { b }", "b"},
+		{"if (1 > 2) { a } else { b + (1 + 1) }", "(b + 2)"},
+		{"if (1) { a }", "a"},
+		{"if (false) { a }", "iftrue "},
+		{"if (true) { let a = 1; a } else { b }", "iftrue let a = 1;a"},
+		{"if (x) { 1 + 1 } else { 2 + 2 }", "ifx 2else 4"},
+	}
+
+	for _, tt := range tests {
+		program := Program(parse(t, tt.input))
+
+		if program.String() != tt.expected {
+			t.Errorf("%q folded wrong. want = %q, got = %q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestFoldingKeepsPositions(t *testing.T) {
+	program := Program(parse(t, "x;\n  1 + 2 * 3"))
+
+	folded := program.Statements[1].(*ast.ExpressionStatement).Expression
+	if folded.Pos().Line != 2 || folded.Pos().Column != 5 {
+		t.Errorf("folded literal has wrong position. want = 2:5, got = %d:%d", folded.Pos().Line, folded.Pos().Column)
+	}
+}
+
+// TestFoldingKeepsOutcomes runs generated programs folded and as they are,
+// on both engines the folded program has to produce the same outcome
+func TestFoldingKeepsOutcomes(t *testing.T) {
+	for seed := int64(0); seed < 500; seed++ {
+		original := difftest.NewGenerator(seed).Program()
+		folded := Program(difftest.NewGenerator(seed).Program())
+
+		if want, got := difftest.Evaluate(original), difftest.Evaluate(folded); want != got {
+			t.Errorf("seed %d: folding changed the evaluator outcome of %q.\nwant = %s\ngot  = %s", seed, original, want, got)
+		}
+
+		if want, got := difftest.Execute(original), difftest.Execute(folded); want != got {
+			t.Errorf("seed %d: folding changed the VM outcome of %q.\nwant = %s\ngot  = %s", seed, original, want, got)
+		}
+	}
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors for %q: %v", input, p.Errors())
+	}
+
+	return program
+}
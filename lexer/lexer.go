@@ -4,15 +4,18 @@ import "lookageek.com/ode/token"
 
 // Lexer holds the input string, the current tokenizing position
 // and next position, and the current character as a byte
+// with the line and column it is on
 type Lexer struct {
 	input        string
 	position     int
 	readPosition int
 	ch           byte
+	line         int
+	column       int
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
@@ -20,6 +23,12 @@ func New(input string) *Lexer {
 // readChar reads the character as a byte in readPosition
 // stores it into ch byte and moves both readPosition & position
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+	l.column++
+
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -36,6 +45,7 @@ func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 
 	l.skipWhitespace()
+	position := token.Position{Line: l.line, Column: l.column}
 
 	switch l.ch {
 	case '=':
@@ -96,10 +106,12 @@ func (l *Lexer) NextToken() token.Token {
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Position = position
 			return tok
 		} else if isDigit(l.ch) {
 			tok.Type = token.INT
 			tok.Literal = l.readNumber()
+			tok.Position = position
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
@@ -107,6 +119,7 @@ func (l *Lexer) NextToken() token.Token {
 	}
 
 	l.readChar()
+	tok.Position = position
 	return tok
 }
 
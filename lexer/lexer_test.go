@@ -140,3 +140,41 @@ if (5 < 10) {
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := `let x = "a b";
+  x == 10
+`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"let", 1, 1},
+		{"x", 1, 5},
+		{"=", 1, 7},
+		{"a b", 1, 9},
+		{";", 1, 14},
+		{"x", 2, 3},
+		{"==", 2, 5},
+		{"10", 2, 8},
+		{"", 3, 1},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Errorf("tests[%d] - %q position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLiteral, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
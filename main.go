@@ -1,15 +1,68 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strings"
 
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/debugger"
+	"lookageek.com/ode/fold"
+	"lookageek.com/ode/lexer"
+	"lookageek.com/ode/parser"
 	"lookageek.com/ode/repl"
+	"lookageek.com/ode/vm"
 )
 
+// BytecodeExtension is the file extension `ode build` gives the bytecode files it writes
+const BytecodeExtension = ".odec"
+
+const usage = `usage:
+	ode                          start the REPL
+	ode build [-o out] file.ode  compile file.ode into a bytecode file
+	ode run [-profile] [-profile-output out] file.odec
+	                             verify a bytecode file and run it on the VM
+	ode disasm file.ode|.odec    disassemble a source or bytecode file
+	ode debug file.ode|.odec     run a source or bytecode file in the step debugger
+
+build, disasm and debug fold constants and run the peephole optimizer, -no-optimize turns both off.
+run -profile prints the instructions, time and allocations per function and opcode,
+-profile-output writes them as a pprof profile
+`
+
 // main method is the entrypoint for the REPL interface
+// and the build, run, disasm and debug subcommands
 func main() {
+	if len(os.Args) < 2 {
+		startRepl()
+		return
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "build":
+		err = build(os.Args[2:])
+	case "run":
+		err = run(os.Args[2:])
+	case "disasm":
+		err = disasm(os.Args[2:])
+	case "debug":
+		err = debug(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ode %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func startRepl() {
 	currentUser, err := user.Current()
 	if err != nil {
 		panic(err)
@@ -18,3 +71,217 @@ func main() {
 	fmt.Printf("Feel free to type some commands\n")
 	repl.StartVm(os.Stdin, os.Stdout)
 }
+
+// build compiles a source file and writes the bytecode next to it,
+// or to the path given with -o
+func build(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	output := flags.String("o", "", "path of the bytecode file, defaults to the source path with the "+BytecodeExtension+" extension")
+	noOptimize := flags.Bool("no-optimize", false, "compile without constant folding and the peephole optimizer")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected exactly one source file")
+	}
+	source := flags.Arg(0)
+
+	bytecode, err := compileFile(source, !*noOptimize)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(source, filepath.Ext(source)) + BytecodeExtension
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	err = compiler.WriteBytecode(file, bytecode)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// run loads a bytecode file written by build, verifies it and executes it on the VM
+func run(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	profile := flags.Bool("profile", false, "print where the execution spent its time to stderr")
+	profileOutput := flags.String("profile-output", "", "write the profile to this file in the pprof format, for `go tool pprof`")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected exactly one bytecode file")
+	}
+
+	bytecode, err := loadBytecode(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	program, err := vm.NewProgram(bytecode)
+	if err != nil {
+		return fmt.Errorf("%s: invalid bytecode: %s", flags.Arg(0), err)
+	}
+
+	machine := program.NewVM()
+	if *profile || *profileOutput != "" {
+		machine.EnableProfiling()
+	}
+
+	runErr := machine.Run()
+
+	// the profile of a failed execution still tells where it spent its time
+	err = writeProfile(machine.Profile(), *profile, *profileOutput)
+	if err != nil {
+		return err
+	}
+
+	if runtimeErr, ok := runErr.(*vm.RuntimeError); ok {
+		return fmt.Errorf("executing bytecode failed: %s\n%s", runtimeErr, strings.TrimSuffix(runtimeErr.StackTrace(), "\n"))
+	}
+	if runErr != nil {
+		return fmt.Errorf("executing bytecode failed: %s", runErr)
+	}
+
+	return nil
+}
+
+// writeProfile prints the report of the profile to stderr and writes it to the pprof output file
+func writeProfile(profile *vm.Profile, report bool, output string) error {
+	if report {
+		err := profile.Report(os.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if output == "" {
+		return nil
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+
+	err = profile.WritePprof(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// disasm prints the disassembly of a bytecode file, or of a source file which
+// is compiled first
+func disasm(args []string) error {
+	flags := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	noOptimize := flags.Bool("no-optimize", false, "compile a source file without constant folding and the peephole optimizer")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected exactly one source or bytecode file")
+	}
+
+	bytecode, err := loadOrCompile(flags.Arg(0), !*noOptimize)
+	if err != nil {
+		return err
+	}
+
+	listing, err := bytecode.Disassemble()
+	fmt.Print(listing)
+
+	return err
+}
+
+// debug runs a bytecode file, or a source file which is compiled
+// first, in the step debugger reading its commands from stdin
+func debug(args []string) error {
+	flags := flag.NewFlagSet("debug", flag.ContinueOnError)
+	noOptimize := flags.Bool("no-optimize", false, "compile a source file without constant folding and the peephole optimizer")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected exactly one source or bytecode file")
+	}
+
+	bytecode, err := loadOrCompile(flags.Arg(0), !*noOptimize)
+	if err != nil {
+		return err
+	}
+
+	err = vm.Verify(bytecode)
+	if err != nil {
+		return fmt.Errorf("%s: invalid bytecode: %s", flags.Arg(0), err)
+	}
+
+	debugger.Start(os.Stdin, os.Stdout, bytecode)
+	return nil
+}
+
+// loadOrCompile loads a bytecode file, any other file is compiled as source
+func loadOrCompile(path string, optimize bool) (*compiler.Bytecode, error) {
+	if filepath.Ext(path) == BytecodeExtension {
+		return loadBytecode(path)
+	}
+
+	return compileFile(path, optimize)
+}
+
+func compileFile(source string, optimize bool) (*compiler.Bytecode, error) {
+	input, err := os.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser.New(lexer.New(string(input)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parser errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+
+	if optimize {
+		program = fold.Program(program)
+	}
+
+	comp := compiler.New()
+	comp.SetOptimizations(optimize)
+	err = comp.Compile(program)
+	if err != nil {
+		return nil, fmt.Errorf("compilation failed: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+	bytecode.File = source
+
+	return bytecode, nil
+}
+
+func loadBytecode(path string) (*compiler.Bytecode, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return compiler.ReadBytecode(file)
+}
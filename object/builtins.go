@@ -1,118 +1,144 @@
-package evaluator
-
-import (
-	"fmt"
-	"lookageek.com/ode/object"
-)
-
-var builtins = map[string]*object.Builtin{
-	"len": {
-		Fn: func(args ...object.Object) object.Object {
+package object
+
+import "fmt"
+
+// Builtins is the registry of the built-in functions shared by the evaluator
+// and the VM. The compiler refers to a builtin by its index in this slice,
+// so new builtins have to be appended at the end to keep the indexes stable.
+// A builtin returning nil has no value, both engines turn that into null
+var Builtins = []struct {
+	Name    string
+	Builtin *Builtin
+}{
+	{
+		"len",
+		&Builtin{Fn: func(args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got = %d, want = 1", len(args))
 			}
 
 			switch arg := args[0].(type) {
-			case *object.Array:
-				return &object.Integer{Value: int64(len(arg.Elements))}
-			case *object.String:
-				return &object.Integer{Value: int64(len(arg.Value))}
+			case *Array:
+				return NewInteger(int64(len(arg.Elements)))
+			case *String:
+				return NewInteger(int64(len(arg.Value)))
 			default:
 				return newError("argument to `len` not supported, got %s", args[0].Type())
 			}
-		},
+		}},
+	},
+	{
+		"puts",
+		&Builtin{Fn: func(args ...Object) Object {
+			for _, arg := range args {
+				fmt.Println(arg.Inspect())
+			}
+
+			return nil
+		}},
 	},
 	// "first" built-in function is implemented only for array data type
-	"first": {
-		Fn: func(args ...object.Object) object.Object {
+	{
+		"first",
+		&Builtin{Fn: func(args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got = %d, want = 1", len(args))
 			}
 
-			if args[0].Type() != object.ARRAY_OBJ {
+			if args[0].Type() != ARRAY_OBJ {
 				return newError("argument to `first` must be ARRAY, got %s", args[0].Type())
 			}
 
-			arr := args[0].(*object.Array)
+			arr := args[0].(*Array)
 			if len(arr.Elements) > 0 {
 				return arr.Elements[0]
 			}
 
-			return NULL
-		},
+			return nil
+		}},
 	},
 	// "last" built-in function is implemented only for array data type
-	"last": {
-		Fn: func(args ...object.Object) object.Object {
+	{
+		"last",
+		&Builtin{Fn: func(args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got = %d, want = 1", len(args))
 			}
 
-			if args[0].Type() != object.ARRAY_OBJ {
+			if args[0].Type() != ARRAY_OBJ {
 				return newError("argument to `last` must be ARRAY, got %s", args[0].Type())
 			}
 
-			arr := args[0].(*object.Array)
+			arr := args[0].(*Array)
 			length := len(arr.Elements)
 
 			if length > 0 {
 				return arr.Elements[length-1]
 			}
 
-			return NULL
-		},
+			return nil
+		}},
 	},
 	// "rest" built-in function is implemented on array type providing all elements but the first
-	"rest": {
-		Fn: func(args ...object.Object) object.Object {
+	{
+		"rest",
+		&Builtin{Fn: func(args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got = %d, want = 1", len(args))
 			}
 
-			if args[0].Type() != object.ARRAY_OBJ {
+			if args[0].Type() != ARRAY_OBJ {
 				return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
 			}
 
-			arr := args[0].(*object.Array)
+			arr := args[0].(*Array)
 			length := len(arr.Elements)
 			if length > 0 {
-				newElements := make([]object.Object, length-1, length-1)
+				newElements := make([]Object, length-1, length-1)
 				copy(newElements, arr.Elements[1:length])
-				return &object.Array{Elements: newElements}
+				return &Array{Elements: newElements}
 			}
 
-			return NULL
-		},
+			return nil
+		}},
 	},
 	// "push" built-in function is implemented on array type pushing an element at the end of the array
 	// it creates a new array with added element rather than modify the array in-place
-	"push": {
-		Fn: func(args ...object.Object) object.Object {
+	{
+		"push",
+		&Builtin{Fn: func(args ...Object) Object {
 			if len(args) != 2 {
 				return newError("wrong number of arguments. got = %d, want = 2", len(args))
 			}
 
-			if args[0].Type() != object.ARRAY_OBJ {
+			if args[0].Type() != ARRAY_OBJ {
 				return newError("argument to `push` must be ARRAY, got %s", args[0].Type())
 			}
 
-			arr := args[0].(*object.Array)
+			arr := args[0].(*Array)
 			length := len(arr.Elements)
 
-			newElements := make([]object.Object, length+1, length+1)
+			newElements := make([]Object, length+1, length+1)
 			copy(newElements, arr.Elements)
 			newElements[length] = args[1]
 
-			return &object.Array{Elements: newElements}
-		},
+			return &Array{Elements: newElements}
+		}},
 	},
-	"puts": {
-		Fn: func(args ...object.Object) object.Object {
-			for _, arg := range args {
-				fmt.Println(arg.Inspect())
-			}
+}
 
-			return NULL
-		},
-	},
+// GetBuiltinByName looks up a builtin in the registry, returns nil if there is none by that name
+func GetBuiltinByName(name string) *Builtin {
+	for _, def := range Builtins {
+		if def.Name == name {
+			return def.Builtin
+		}
+	}
+
+	return nil
+}
+
+// newError is a constructor for the error object returned by the builtins
+func newError(format string, a ...interface{}) *Error {
+	return &Error{Message: fmt.Sprintf(format, a...)}
 }
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"sort"
 	"strings"
 
 	"lookageek.com/ode/ast"
+	"lookageek.com/ode/code"
 )
 
 type ObjectType string
@@ -23,6 +25,9 @@ const (
 	BUILTIN_OBJ      = "BUILTIN"
 	ARRAY_OBJ        = "ARRAY"
 	HASH_OBJ         = "HASH"
+
+	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
+	CLOSURE_OBJ           = "CLOSURE"
 )
 
 // Object holds the literal values for integer, boolean and null
@@ -56,6 +61,36 @@ func (i *Integer) HashKey() HashKey {
 	}
 }
 
+// the integers from MinCachedInteger to MaxCachedInteger are allocated once and
+// shared, counters, indexes and small results then need no allocation at all
+const (
+	MinCachedInteger = -128
+	MaxCachedInteger = 1024
+)
+
+var cachedIntegers = func() []*Integer {
+	integers := make([]*Integer, MaxCachedInteger-MinCachedInteger+1)
+	for i := range integers {
+		integers[i] = &Integer{Value: int64(i + MinCachedInteger)}
+	}
+	return integers
+}()
+
+// NewInteger returns the integer object of the value, shared with everyone else
+// if the value is in the cached range. Integers must never be modified for that reason
+func NewInteger(value int64) *Integer {
+	if IsCachedInteger(value) {
+		return cachedIntegers[value-MinCachedInteger]
+	}
+
+	return &Integer{Value: value}
+}
+
+// IsCachedInteger tells whether NewInteger returns a shared object for the value
+func IsCachedInteger(value int64) bool {
+	return value >= MinCachedInteger && value <= MaxCachedInteger
+}
+
 // Boolean holds the literal boolean value
 type Boolean struct {
 	Value bool
@@ -81,6 +116,14 @@ type Null struct{}
 func (n *Null) Type() ObjectType { return NULL_OBJ }
 func (n *Null) Inspect() string  { return "null" }
 
+// TRUE, FALSE and NULL are the only boolean and null objects the evaluator and
+// the VM ever create, comparing them is then just a pointer comparison
+var (
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+	NULL  = &Null{}
+)
+
 // ReturnValue holds the object representation of
 // evaluated return value in the return statement
 type ReturnValue struct {
@@ -98,6 +141,9 @@ func (rv *ReturnValue) Inspect() string {
 // Error object holds the error encountered during the evaluation
 type Error struct {
 	Message string
+	// Err is the Go error behind the error, the evaluator sets it when a limit is
+	// exceeded or its context is done. It is nil for the errors of the program
+	Err error
 }
 
 func (e *Error) Type() ObjectType {
@@ -146,6 +192,9 @@ type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+	// Name is the name the function literal is bound to with a let statement,
+	// empty for anonymous functions
+	Name string
 }
 
 func (f *Function) Type() ObjectType {
@@ -241,6 +290,8 @@ func (h *Hash) Inspect() string {
 	for _, pair := range h.Pairs {
 		pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), pair.Value.Inspect()))
 	}
+	// go maps have no stable iteration order, sort so the same hash always looks the same
+	sort.Strings(pairs)
 
 	out.WriteString("{")
 	out.WriteString(strings.Join(pairs, ", "))
@@ -248,3 +299,33 @@ func (h *Hash) Inspect() string {
 
 	return out.String()
 }
+
+// CompiledFunction holds the bytecode of a function literal, it is added as a
+// constant by the compiler and executed by the VM in a frame of its own.
+// Name is the name the function was bound to by a let statement, if any
+type CompiledFunction struct {
+	Instructions  code.Instructions
+	NumLocals     int
+	NumParameters int
+	Name          string
+	Positions     code.PositionTable
+	// LocalNames are the names of the parameters and local bindings indexed by their slot
+	LocalNames []string
+}
+
+func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
+func (cf *CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", cf)
+}
+
+// Closure is what the VM calls, a compiled function together with the free
+// variables it captured when the function literal was evaluated
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []Object
+}
+
+func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
+}
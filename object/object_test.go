@@ -58,3 +58,16 @@ func TestIntegerHashKey(t *testing.T) {
 		t.Errorf("integers with twoerent content have same hash keys")
 	}
 }
+
+func TestHashInspectIsSorted(t *testing.T) {
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	for _, key := range []string{"c", "a", "b"} {
+		k := &String{Value: key}
+		hash.Pairs[k.HashKey()] = HashPair{Key: k, Value: &Integer{Value: 1}}
+	}
+
+	expected := "{a: 1, b: 1, c: 1}"
+	if hash.Inspect() != expected {
+		t.Errorf("hash inspected wrongly. want = %q, got = %q", expected, hash.Inspect())
+	}
+}
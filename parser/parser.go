@@ -158,6 +158,11 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 
 	stmt.Value = p.parseExpression(LOWEST)
 
+	// a function literal bound with let knows its own name
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -426,10 +431,40 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	}
 
 	lit.Body = p.parseBlockStatement()
+	markTailCalls(lit.Body, true)
 
 	return lit
 }
 
+// markTailCalls marks the calls in tail position of a function body, the calls whose
+// value is returned: the values of return statements, and the last expression of the
+// body when tail is set, also inside the branches of an if expression
+func markTailCalls(block *ast.BlockStatement, tail bool) {
+	if block == nil {
+		return
+	}
+
+	for i, s := range block.Statements {
+		switch s := s.(type) {
+		case *ast.ReturnStatement:
+			markTailCall(s.ReturnValue, true)
+		case *ast.ExpressionStatement:
+			markTailCall(s.Expression, tail && i == len(block.Statements)-1)
+		}
+	}
+}
+
+func markTailCall(e ast.Expression, tail bool) {
+	switch e := e.(type) {
+	case *ast.CallExpression:
+		e.Tail = tail
+	case *ast.IfExpression:
+		// the return statements of the branches are tail calls even when the if is not
+		markTailCalls(e.Consequence, tail)
+		markTailCalls(e.Alternative, tail)
+	}
+}
+
 // parseFunctionParameters parses the function parameters, if there are
 // no function params, empty list is returned
 func (p *Parser) parseFunctionParameters() []*ast.Identifier {
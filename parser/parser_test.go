@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 
 	"lookageek.com/ode/ast"
@@ -678,6 +679,35 @@ func TestFunctionLiteralParsing(t *testing.T) {
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
 
+func TestFunctionLiteralWithName(t *testing.T) {
+	input := `let myFunction = fn() { };`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got = %d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.LetStatement. got = %T",
+			program.Statements[0])
+	}
+
+	function, ok := stmt.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("stmt.Value is not ast.FunctionLiteral. got = %T", stmt.Value)
+	}
+
+	if function.Name != "myFunction" {
+		t.Fatalf("function literal name wrong. want 'myFunction', got = %q\n", function.Name)
+	}
+}
+
 func TestFunctionParameterParsing(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -1038,3 +1068,80 @@ func TestParsingHashLiteralWithExpression(t *testing.T) {
 		testFunc(value)
 	}
 }
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected map[string]bool
+	}{
+		{"fn() { a() }", map[string]bool{"a": true}},
+		{"fn() { a(); b() }", map[string]bool{"a": false, "b": true}},
+		{"fn() { a() + 1 }", map[string]bool{"a": false}},
+		{"fn() { a(b()) }", map[string]bool{"a": true, "b": false}},
+		{"fn() { return a(); b() }", map[string]bool{"a": true, "b": true}},
+		{"fn() { let x = a(); x }", map[string]bool{"a": false}},
+		{"fn() { if (a()) { b() } else { c() } }", map[string]bool{"a": false, "b": true, "c": true}},
+		{"fn() { if (x) { return a() }; b() }", map[string]bool{"a": true, "b": true}},
+		{"fn() { if (x) { a() }; b() }", map[string]bool{"a": false, "b": true}},
+		{"fn() { fn() { a() }; b() }", map[string]bool{"a": true, "b": true}},
+		{"fn() { fn() { a() }() }", map[string]bool{"a": true, "fn": true}},
+		// the main program has no function to return from
+		{"a(); return b();", map[string]bool{"a": false, "b": false}},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		calls := map[string]bool{}
+		collectCalls(program, calls)
+
+		if !reflect.DeepEqual(calls, tt.expected) {
+			t.Errorf("%q: wrong tail calls. want = %v, got = %v", tt.input, tt.expected, calls)
+		}
+	}
+}
+
+// collectCalls records for every call whether it is a tail call, the calls are
+// named by the identifier they call or fn for a called function literal
+func collectCalls(node ast.Node, calls map[string]bool) {
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			collectCalls(s, calls)
+		}
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			collectCalls(s, calls)
+		}
+	case *ast.ExpressionStatement:
+		collectCalls(node.Expression, calls)
+	case *ast.ReturnStatement:
+		collectCalls(node.ReturnValue, calls)
+	case *ast.LetStatement:
+		collectCalls(node.Value, calls)
+	case *ast.InfixExpression:
+		collectCalls(node.Left, calls)
+		collectCalls(node.Right, calls)
+	case *ast.IfExpression:
+		collectCalls(node.Condition, calls)
+		collectCalls(node.Consequence, calls)
+		if node.Alternative != nil {
+			collectCalls(node.Alternative, calls)
+		}
+	case *ast.FunctionLiteral:
+		collectCalls(node.Body, calls)
+	case *ast.CallExpression:
+		name := node.Function.String()
+		if _, ok := node.Function.(*ast.FunctionLiteral); ok {
+			name = "fn"
+		}
+		calls[name] = node.Tail
+
+		collectCalls(node.Function, calls)
+		for _, a := range node.Arguments {
+			collectCalls(a, calls)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"lookageek.com/ode/compiler"
 	"lookageek.com/ode/evaluator"
+	"lookageek.com/ode/fold"
 	"lookageek.com/ode/lexer"
 	"lookageek.com/ode/object"
 	"lookageek.com/ode/parser"
@@ -41,7 +42,7 @@ func Start(in io.Reader, out io.Writer) {
 			continue
 		}
 
-		evaluated := evaluator.Eval(program, env)
+		evaluated := evaluator.Eval(fold.Program(program), env)
 
 		if evaluated != nil {
 			io.WriteString(out, evaluated.Inspect())
@@ -50,9 +51,15 @@ func Start(in io.Reader, out io.Writer) {
 	}
 }
 
+// StartVm is the REPL running on the compiler and the VM, the constants,
+// symbol table and globals are kept across lines like the environment in Start
 func StartVm(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
 
+	constants := []object.Object{}
+	var globals []object.Object
+	symbolTable := compiler.NewSymbolTableWithBuiltins()
+
 	for {
 		fmt.Fprintf(out, PROMPT)
 		// wait for code to be entered in the terminal
@@ -73,23 +80,37 @@ func StartVm(in io.Reader, out io.Writer) {
 			continue
 		}
 
-		comp := compiler.New()
-		err := comp.Compile(program)
+		// the line is compiled against a copy of the symbol table, the names
+		// defined by a line which does not compile are never bound and dropped
+		lineSymbols := symbolTable.Copy()
+		comp := compiler.NewWithState(lineSymbols, constants)
+		err := comp.Compile(fold.Program(program))
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Compilation failed:\n%s\n", err)
 			continue
 		}
 
-		machine := vm.New(comp.Bytecode())
+		symbolTable = lineSymbols
+		bytecode := comp.Bytecode()
+		constants = bytecode.Constants
+
+		machine := vm.NewWithGlobalsStore(bytecode, globals)
 		err = machine.Run()
+		// the store grows as lines bind globals, the globals bound before a failure stay
+		globals = machine.Globals()
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n%s\n", err)
+			if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+				io.WriteString(out, runtimeErr.StackTrace())
+			}
 			continue
 		}
 
-		stackTop := machine.StackTop()
-		io.WriteString(out, stackTop.Inspect())
-		io.WriteString(out, "\n")
+		lastPopped := machine.LastPoppedStackElem()
+		if lastPopped != nil {
+			io.WriteString(out, lastPopped.Inspect())
+			io.WriteString(out, "\n")
+		}
 	}
 }
 
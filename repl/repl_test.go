@@ -0,0 +1,46 @@
+package repl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStartVm(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    string
+		expected string
+	}{
+		{
+			"bindings are kept across lines",
+			"let a = 1;\nlet b = fn(x) { x + a };\nb(2)\n",
+			">> >> >> 3\n>> ",
+		},
+		{
+			"names of a line which does not compile are not defined",
+			"let b = 2; c\nb\n",
+			">> Woops! Compilation failed:\nidentifier not found: c\n" +
+				">> Woops! Compilation failed:\nidentifier not found: b\n>> ",
+		},
+		{
+			"a name of a line which does not compile keeps its earlier binding",
+			"let a = 1;\nlet a = 2; let b = 3; c\na\n",
+			">> >> Woops! Compilation failed:\nidentifier not found: c\n>> 1\n>> ",
+		},
+		{
+			"the next name defined takes the slot of the dropped name",
+			"let b = 2; c\nlet d = 4;\nd\n",
+			">> Woops! Compilation failed:\nidentifier not found: c\n>> >> 4\n>> ",
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		StartVm(strings.NewReader(tt.lines), &out)
+
+		if out.String() != tt.expected {
+			t.Errorf("%s: wrong output.\nwant = %q\ngot = %q", tt.name, tt.expected, out.String())
+		}
+	}
+}
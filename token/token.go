@@ -39,10 +39,23 @@ type TokenType string
 
 // Token has two values - what type the token is, referred
 // from the constant lookup set of all possible token types
-// and the value of the token
+// and the value of the token, along with where it starts in the source
 type Token struct {
 	Type    TokenType
 	Literal string
+	Position
+}
+
+// Position is a line and column in the source, both start at 1,
+// the zero Position is used for nodes which do not come from source
+type Position struct {
+	Line   int
+	Column int
+}
+
+// IsValid reports whether the position is known
+func (p Position) IsValid() bool {
+	return p.Line > 0
 }
 
 var keywords = map[string]TokenType{
@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"fmt"
+
+	"lookageek.com/ode/code"
+)
+
+// instructionWidths is the length of every opcode's instruction including its
+// operands, it is 0 for the bytes which are not an opcode
+var instructionWidths [256]int
+
+// stackInputs is the number of values an opcode pops off the stack. The opcodes
+// which pop as many values as their operand says are checked when they are executed
+var stackInputs = [256]int{
+	code.OpAdd:           2,
+	code.OpSub:           2,
+	code.OpMul:           2,
+	code.OpDiv:           2,
+	code.OpEqual:         2,
+	code.OpNotEqual:      2,
+	code.OpGreaterThan:   2,
+	code.OpLessThan:      2,
+	code.OpPop:           1,
+	code.OpMinus:         1,
+	code.OpBang:          1,
+	code.OpJumpNotTruthy: 1,
+	code.OpSetGlobal:     1,
+	code.OpIndex:         2,
+	code.OpReturnValue:   1,
+	code.OpSetLocal:      1,
+	code.OpAddConstant:   1,
+	code.OpSubConstant:   1,
+}
+
+func init() {
+	for b := 0; b < len(instructionWidths); b++ {
+		def, err := code.Lookup(byte(b))
+		if err != nil {
+			continue
+		}
+
+		width := 1
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		instructionWidths[b] = width
+	}
+}
+
+// checkInstruction validates the instruction at ip before it is executed, the
+// opcode has to be defined, its operands complete and the values it pops on the stack
+func (vm *VM) checkInstruction(op code.Opcode, ins code.Instructions, ip int) error {
+	width := instructionWidths[op]
+	if width == 0 {
+		return fmt.Errorf("opcode %d undefined", op)
+	}
+
+	if ip+width > len(ins) {
+		return fmt.Errorf("instruction truncated")
+	}
+
+	return vm.checkStack(stackInputs[op])
+}
+
+// checkStack makes sure n values can be popped, the stack below the
+// locals of the current frame belongs to the callers and is off limits
+func (vm *VM) checkStack(n int) error {
+	frame := vm.currentFrame()
+	available := vm.sp - (frame.basePointer + frame.cl.Fn.NumLocals)
+
+	if available < n {
+		return fmt.Errorf("stack underflow: needs %d values, has %d", n, available)
+	}
+
+	return nil
+}
+
+// checkConstant makes sure the constant index is inside of the constant pool
+func (vm *VM) checkConstant(index int) error {
+	if index >= len(vm.constants) {
+		return fmt.Errorf("constant %d out of range, there are %d constants", index, len(vm.constants))
+	}
+
+	return nil
+}
+
+// checkGlobal checks the index against the size the globals store can grow to, which
+// can be smaller than the 2 byte operands of OpSetGlobal and OpGetGlobal reach
+func (vm *VM) checkGlobal(index int) error {
+	if index >= vm.maxGlobals {
+		return fmt.Errorf("global %d out of range, there are %d globals", index, vm.maxGlobals)
+	}
+
+	return nil
+}
+
+// checkLocal makes sure the local index is one of the current frame's locals
+func (vm *VM) checkLocal(index int) error {
+	if numLocals := vm.currentFrame().cl.Fn.NumLocals; index >= numLocals {
+		return fmt.Errorf("local %d out of range, the function has %d locals", index, numLocals)
+	}
+
+	return nil
+}
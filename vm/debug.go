@@ -0,0 +1,94 @@
+package vm
+
+import (
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/object"
+	"lookageek.com/ode/token"
+)
+
+// Debugger is called by the VM before every instruction it executes, the VM passes
+// itself so the debugger can inspect it. An error returned by Step stops the
+// execution, Run then fails with it
+type Debugger interface {
+	Step(vm *VM) error
+}
+
+// SetDebugger installs the debugger Run calls before every instruction, nil removes it
+func (vm *VM) SetDebugger(d Debugger) {
+	vm.debugger = d
+}
+
+// the methods below describe the instruction which is about to be executed,
+// they are meant to be called by a Debugger
+
+// Depth is the number of frames on the frame stack, 1 in the main program
+func (vm *VM) Depth() int {
+	return vm.framesIndex
+}
+
+// Function is the name of the function being executed, as it appears in stack traces
+func (vm *VM) Function() string {
+	return vm.functionName(vm.framesIndex - 1)
+}
+
+// Offset is the offset of the instruction in the instructions of the function
+func (vm *VM) Offset() int {
+	return vm.currentFrame().ip
+}
+
+// Position is the source position the instruction was compiled from,
+// it is invalid for bytecode without positions
+func (vm *VM) Position() token.Position {
+	return vm.currentFrame().cl.Fn.Positions.Lookup(vm.currentFrame().ip)
+}
+
+// Instruction is the disassembled instruction
+func (vm *VM) Instruction() string {
+	text, err := code.DisassembleInstruction(vm.currentFrame().Instructions(), vm.currentFrame().ip,
+		compiler.DisassemblyConstants(vm.constants))
+	if err != nil {
+		return err.Error()
+	}
+
+	return text
+}
+
+// Stack is the operand stack of the function, without the locals
+// below it, the bottom of the stack comes first
+func (vm *VM) Stack() []object.Object {
+	frame := vm.currentFrame()
+	bottom := frame.basePointer + frame.cl.Fn.NumLocals
+	if vm.sp < bottom {
+		return nil
+	}
+
+	return vm.stack[bottom:vm.sp]
+}
+
+// Locals are the parameters and local bindings of the function, empty in the main
+// program. A local is nil until its let statement is executed
+func (vm *VM) Locals() []object.Object {
+	frame := vm.currentFrame()
+	return vm.stack[frame.basePointer : frame.basePointer+frame.cl.Fn.NumLocals]
+}
+
+// Globals is the globals store indexed by the global's index, a global is nil until it is set
+func (vm *VM) Globals() []object.Object {
+	return vm.globals
+}
+
+// CallStack is the call stack with the innermost call first, as RuntimeError reports it
+func (vm *VM) CallStack() []CallFrame {
+	callStack := []CallFrame{}
+
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		callStack = append(callStack, CallFrame{
+			Function: vm.functionName(i),
+			Position: frame.cl.Fn.Positions.Lookup(frame.ip),
+		})
+	}
+
+	return callStack
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"lookageek.com/ode/compiler"
+)
+
+// recorder is a Debugger which records every instruction it is called for
+type recorder struct {
+	steps []string
+	// failAt stops the execution at the instruction with this number of steps before it
+	failAt int
+}
+
+func (r *recorder) Step(vm *VM) error {
+	if len(r.steps) == r.failAt {
+		return fmt.Errorf("stopped")
+	}
+
+	r.steps = append(r.steps, fmt.Sprintf("%d %s %s stack=%d", vm.Depth(), vm.Function(), vm.Instruction(), len(vm.Stack())))
+	return nil
+}
+
+func TestDebugger(t *testing.T) {
+	comp := compiler.New()
+	comp.SetOptimizations(false)
+	err := comp.Compile(parse("let one = fn() { 1 }; one() + 2"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []string{
+		"1 <main> 0000 OpClosure 1 0            ; fn one(params=0, locals=0) stack=0",
+		"1 <main> 0004 OpSetGlobal 0 stack=1",
+		"1 <main> 0007 OpGetGlobal 0 stack=0",
+		"1 <main> 0010 OpCall 0 stack=1",
+		"2 one 0000 OpConstant 0             ; 1 stack=0",
+		"2 one 0003 OpReturnValue stack=1",
+		"1 <main> 0012 OpConstant 2             ; 2 stack=1",
+		"1 <main> 0015 OpAdd stack=2",
+		"1 <main> 0016 OpPop stack=1",
+	}
+
+	debugger := &recorder{failAt: -1}
+	machine := New(comp.Bytecode())
+	machine.SetDebugger(debugger)
+
+	err = machine.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if !reflect.DeepEqual(debugger.steps, expected) {
+		t.Errorf("wrong steps.\nwant = %q\ngot  = %q", expected, debugger.steps)
+	}
+
+	// an error of the debugger stops the execution before the instruction
+	debugger = &recorder{failAt: 5}
+	machine = New(comp.Bytecode())
+	machine.SetDebugger(debugger)
+
+	err = machine.Run()
+	if err == nil || runtimeErrorMessage(t, err) != "stopped" {
+		t.Fatalf("expected the debugger to stop the VM, got = %v", err)
+	}
+
+	if len(machine.CallStack()) != 2 || machine.Offset() != 3 {
+		t.Errorf("wrong stop. want = depth 2 at 0003, got = depth %d at %04d", len(machine.CallStack()), machine.Offset())
+	}
+}
@@ -0,0 +1,187 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/object"
+	"lookageek.com/ode/token"
+)
+
+// maxTraceFrames is the number of innermost and outermost frames StackTrace
+// prints, the frames in between are only counted
+const maxTraceFrames = 10
+
+// ErrUnset is wrapped by the runtime errors of a program reading a global or a local
+// which was never set, e.g. one bound by a let statement in a branch that did not run
+var ErrUnset = errors.New("used before it is set")
+
+// bindingName is the name of the global or local in the slot for an error message,
+// bytecode without names, e.g. assembled by hand, gets the kind and the slot instead
+func bindingName(kind string, names []string, index int) string {
+	if index < len(names) && names[index] != "" {
+		return names[index]
+	}
+
+	return fmt.Sprintf("%s %d", kind, index)
+}
+
+// RuntimeError is returned by Run when the execution fails. Besides the message it
+// names the failing instruction, locates it in the source, and holds the call stack
+// at the time of the failure with the innermost call first
+type RuntimeError struct {
+	Message string
+
+	// Opcode is the failing instruction, Offset is where it starts in the
+	// instructions of the innermost function of the call stack
+	Opcode code.Opcode
+	Offset int
+	// OperandTypes are the types of the values the instruction failed on,
+	// empty when the failure is not caused by the type of a value
+	OperandTypes []object.ObjectType
+
+	File      string
+	Position  token.Position
+	CallStack []CallFrame
+
+	// Err is the error the instruction failed with, errors.Is(err, budget.ErrSteps)
+	// and errors.Is(err, context.Canceled) tell the executions which were stopped
+	Err error
+}
+
+// CallFrame is a function which was being executed when the runtime error
+// happened, with the position it was executing
+type CallFrame struct {
+	Function string
+	Position token.Position
+}
+
+// Error is the message prefixed with file:line:col of the failing instruction,
+// or with the instruction itself when the bytecode has no positions
+func (e *RuntimeError) Error() string {
+	if !e.Position.IsValid() {
+		return fmt.Sprintf("%s at %04d: %s", opcodeName(e.Opcode), e.Offset, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", location(e.File, e.Position), e.Message)
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+func opcodeName(op code.Opcode) string {
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		return fmt.Sprintf("opcode %d", op)
+	}
+
+	return def.Name
+}
+
+// StackTrace lists the call stack one frame per line, innermost first
+func (e *RuntimeError) StackTrace() string {
+	var out bytes.Buffer
+
+	for i, frame := range e.CallStack {
+		if len(e.CallStack) > 2*maxTraceFrames && i == maxTraceFrames {
+			fmt.Fprintf(&out, "\t... %d more frames\n", len(e.CallStack)-2*maxTraceFrames)
+		}
+		if len(e.CallStack) > 2*maxTraceFrames && i >= maxTraceFrames && i < len(e.CallStack)-maxTraceFrames {
+			continue
+		}
+
+		if frame.Position.IsValid() {
+			fmt.Fprintf(&out, "\tat %s (%s)\n", frame.Function, location(e.File, frame.Position))
+		} else {
+			fmt.Fprintf(&out, "\tat %s\n", frame.Function)
+		}
+	}
+
+	return out.String()
+}
+
+func location(file string, position token.Position) string {
+	if file == "" {
+		return fmt.Sprintf("%d:%d", position.Line, position.Column)
+	}
+
+	return fmt.Sprintf("%s:%d:%d", file, position.Line, position.Column)
+}
+
+// instructionError is the error of the instruction starting at offset in the current frame
+type instructionError struct {
+	op     code.Opcode
+	offset int
+	err    error
+}
+
+func (e *instructionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *instructionError) Unwrap() error {
+	return e.err
+}
+
+// operandError is an error caused by the types of the values an instruction operates on
+type operandError struct {
+	message string
+	types   []object.ObjectType
+}
+
+func (e *operandError) Error() string {
+	return e.message
+}
+
+func newOperandError(operands []object.Object, format string, a ...interface{}) error {
+	types := make([]object.ObjectType, len(operands))
+	for i, operand := range operands {
+		types[i] = operand.Type()
+	}
+
+	return &operandError{message: fmt.Sprintf(format, a...), types: types}
+}
+
+// runtimeError wraps an error of an instruction into a RuntimeError, with
+// the call stack of the frames which are still on the frame stack
+func (vm *VM) runtimeError(err error) *RuntimeError {
+	callStack := vm.CallStack()
+
+	runtimeErr := &RuntimeError{
+		Message:   err.Error(),
+		Err:       err,
+		File:      vm.file,
+		Position:  callStack[0].Position,
+		CallStack: callStack,
+	}
+
+	var insErr *instructionError
+	if errors.As(err, &insErr) {
+		runtimeErr.Opcode = insErr.op
+		runtimeErr.Offset = insErr.offset
+	}
+
+	var opErr *operandError
+	if errors.As(err, &opErr) {
+		runtimeErr.OperandTypes = opErr.types
+	}
+
+	return runtimeErr
+}
+
+// functionName is how the function of the frame at index is called in stack traces
+func (vm *VM) functionName(index int) string {
+	if index == 0 {
+		return "<main>"
+	}
+
+	name := vm.frames[index].cl.Fn.Name
+	if name == "" {
+		return "<fn>"
+	}
+
+	return name
+}
@@ -0,0 +1,25 @@
+package vm
+
+import (
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/object"
+)
+
+// Frame is the call frame (activation record) of a function being executed,
+// it carries its own instruction pointer so returning from a call continues
+// the caller right where it left off
+type Frame struct {
+	cl *object.Closure
+	ip int
+	// basePointer is the stack pointer at the time of the call, the locals of
+	// the function live in the stack slots starting at basePointer
+	basePointer int
+}
+
+func NewFrame(cl *object.Closure, basePointer int) *Frame {
+	return &Frame{cl: cl, ip: -1, basePointer: basePointer}
+}
+
+func (f *Frame) Instructions() code.Instructions {
+	return f.cl.Fn.Instructions
+}
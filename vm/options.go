@@ -0,0 +1,109 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"lookageek.com/ode/object"
+)
+
+// InitialStackSize is the number of values the stack of a new VM holds, it grows on
+// demand up to its maximum size so short programs like the lines of the REPL stay small
+const InitialStackSize = 64
+
+// ErrStackOverflow is wrapped by the runtime errors of a VM running out of stack or frames
+var ErrStackOverflow = errors.New("stack overflow")
+
+// Option configures a VM created by New. The sizes and limits the options set have to
+// be at least 1, an option with a smaller value is ignored and the default stays
+type Option func(vm *VM)
+
+// WithInitialStackSize sets the number of values the stack holds before it has to grow
+func WithInitialStackSize(size int) Option {
+	return func(vm *VM) {
+		if size > 0 {
+			vm.stack = make([]object.Object, size)
+		}
+	}
+}
+
+// WithMaxStackSize sets the number of values the stack can grow to, StackSize by default
+func WithMaxStackSize(size int) Option {
+	return func(vm *VM) {
+		if size > 0 {
+			vm.maxStackSize = size
+		}
+	}
+}
+
+// WithMaxFrames sets how deep calls can be nested, MaxFrames by default.
+// The main program takes a frame as well, with 1 frame no call can be made
+func WithMaxFrames(frames int) Option {
+	return func(vm *VM) {
+		if frames > 0 {
+			vm.maxFrames = frames
+		}
+	}
+}
+
+// WithGlobalsSize sets the number of globals the program can bind, GlobalsSize by default
+func WithGlobalsSize(size int) Option {
+	return func(vm *VM) {
+		if size > 0 {
+			vm.maxGlobals = size
+		}
+	}
+}
+
+// growGlobals makes room for the global at index in the globals store, the store
+// at least doubles like the stack. It fails for an index beyond the maximum size
+func (vm *VM) growGlobals(index int) error {
+	if index < len(vm.globals) {
+		return nil
+	}
+
+	err := vm.checkGlobal(index)
+	if err != nil {
+		return err
+	}
+
+	newSize := 2 * len(vm.globals)
+	if newSize <= index {
+		newSize = index + 1
+	}
+	if newSize > vm.maxGlobals {
+		newSize = vm.maxGlobals
+	}
+
+	globals := make([]object.Object, newSize)
+	copy(globals, vm.globals)
+	vm.globals = globals
+
+	return nil
+}
+
+// growStack makes room for size values on the stack, the stack at least doubles
+// so pushing stays cheap. It fails once the stack would exceed its maximum size
+func (vm *VM) growStack(size int) error {
+	if size <= len(vm.stack) {
+		return nil
+	}
+
+	if size > vm.maxStackSize {
+		return fmt.Errorf("%w: the stack holds at most %d values", ErrStackOverflow, vm.maxStackSize)
+	}
+
+	newSize := 2 * len(vm.stack)
+	if newSize < size {
+		newSize = size
+	}
+	if newSize > vm.maxStackSize {
+		newSize = vm.maxStackSize
+	}
+
+	stack := make([]object.Object, newSize)
+	copy(stack, vm.stack)
+	vm.stack = stack
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"lookageek.com/ode/compiler"
+)
+
+func compile(t *testing.T, input string) *compiler.Bytecode {
+	t.Helper()
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	return comp.Bytecode()
+}
+
+func TestStackGrows(t *testing.T) {
+	vm := New(compile(t, "let sum = fn(n) { if (n == 0) { 0 } else { n + sum(n - 1) } }; sum(500);"))
+	if len(vm.stack) != InitialStackSize {
+		t.Fatalf("wrong initial stack size. want = %d, got = %d", InitialStackSize, len(vm.stack))
+	}
+
+	err := vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, 125250, vm.LastPoppedStackElem())
+
+	if len(vm.stack) <= InitialStackSize || len(vm.stack) > StackSize {
+		t.Errorf("the stack did not grow within its limit. got = %d", len(vm.stack))
+	}
+}
+
+func TestLargerLimits(t *testing.T) {
+	// sum does not make tail calls, its 20001 nested calls and the main program
+	// need far more frames and stack than MaxFrames and StackSize allow
+	bytecode := compile(t, "let sum = fn(n) { if (n == 0) { 0 } else { n + sum(n - 1) } }; sum(20000);")
+
+	vm := New(bytecode, WithMaxFrames(20002), WithMaxStackSize(1<<17), WithInitialStackSize(8))
+	err := vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, 200010000, vm.LastPoppedStackElem())
+}
+
+func TestStackOverflows(t *testing.T) {
+	bytecode := compile(t, "let sum = fn(n) { if (n == 0) { 0 } else { n + sum(n - 1) } }; sum(1000);")
+
+	tests := []struct {
+		options   []Option
+		expected  string
+		callStack int
+	}{
+		{
+			[]Option{WithMaxFrames(10)},
+			"stack overflow: calls are nested more than 10 frames deep",
+			10,
+		},
+		{
+			// every call takes the callee, its argument and n pushed for the addition
+			[]Option{WithMaxStackSize(100)},
+			"stack overflow: the stack holds at most 100 values",
+			34,
+		},
+		{
+			// the initial size is cut down to the maximum size
+			[]Option{WithInitialStackSize(1000), WithMaxStackSize(100)},
+			"stack overflow: the stack holds at most 100 values",
+			34,
+		},
+	}
+
+	for _, tt := range tests {
+		err := New(bytecode, tt.options...).Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if !errors.Is(err, ErrStackOverflow) {
+			t.Errorf("the error is not a stack overflow. got = %s", err)
+		}
+
+		runtimeErr := err.(*RuntimeError)
+		if runtimeErr.Message != tt.expected {
+			t.Errorf("wrong error. want = %q, got = %q", tt.expected, runtimeErr.Message)
+		}
+
+		// the call chain leading to the overflow
+		callStack := runtimeErr.CallStack
+		if len(callStack) != tt.callStack {
+			t.Errorf("wrong call stack depth. want = %d, got = %d", tt.callStack, len(callStack))
+		}
+		if callStack[0].Function != "sum" || callStack[len(callStack)-1].Function != "<main>" {
+			t.Errorf("wrong call stack. got = %+v", callStack)
+		}
+	}
+}
+
+func TestGlobalsSize(t *testing.T) {
+	bytecode := compile(t, "let a = 1; let b = 2; a + b")
+
+	vm := New(bytecode, WithGlobalsSize(2))
+	err := vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 3, vm.LastPoppedStackElem())
+
+	err = New(bytecode, WithGlobalsSize(1)).Run()
+	expected := "global 1 out of range, there are 1 globals"
+	if err == nil || err.(*RuntimeError).Message != expected {
+		t.Errorf("wrong error. want = %q, got = %v", expected, err)
+	}
+}
+
+func TestGlobalsGrow(t *testing.T) {
+	vm := New(compile(t, "let a = 1; let b = 2; let c = 3; a + b + c"))
+	if len(vm.globals) != 0 {
+		t.Fatalf("the globals are allocated before they are bound. got = %d", len(vm.globals))
+	}
+
+	err := vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, 6, vm.LastPoppedStackElem())
+
+	// the store doubles, it does not grow to GlobalsSize
+	if len(vm.globals) != 4 {
+		t.Errorf("wrong size of the globals store. want = 4, got = %d", len(vm.globals))
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	bytecode := compile(t, "let sum = fn(n) { if (n == 0) { 0 } else { n + sum(n - 1) } }; sum(10);")
+
+	for _, size := range []int{0, -1} {
+		vm := New(bytecode, WithInitialStackSize(size), WithMaxStackSize(size), WithMaxFrames(size), WithGlobalsSize(size))
+
+		// the options are ignored, the defaults stay
+		if len(vm.stack) != InitialStackSize || vm.maxStackSize != StackSize {
+			t.Errorf("wrong stack sizes for %d. got = %d, %d", size, len(vm.stack), vm.maxStackSize)
+		}
+		if vm.maxFrames != MaxFrames || vm.maxGlobals != GlobalsSize {
+			t.Errorf("wrong frames or globals for %d. got = %d, %d", size, vm.maxFrames, vm.maxGlobals)
+		}
+
+		err := vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, 55, vm.LastPoppedStackElem())
+	}
+}
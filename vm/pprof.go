@@ -0,0 +1,227 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"lookageek.com/ode/object"
+)
+
+// the fields of the messages in the profile.proto of pprof
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+// WritePprof writes the call tree as a gzipped pprof profile, which `go tool pprof`
+// reads. Every node of the tree is a sample with its instructions, self time,
+// allocations and calls, the locations are the compiled functions
+func (p *Profile) WritePprof(w io.Writer) error {
+	e := &pprofEncoder{
+		strings:     map[string]int{"": 0},
+		stringTable: []string{""},
+		functions:   map[*object.CompiledFunction]uint64{},
+		file:        p.file,
+	}
+
+	sampleTypes := [][2]string{
+		{"instructions", "count"},
+		{"time", "nanoseconds"},
+		{"allocations", "count"},
+		{"calls", "count"},
+	}
+	for _, sampleType := range sampleTypes {
+		e.profile.message(profileSampleType, e.valueType(sampleType[0], sampleType[1]))
+	}
+
+	e.samples(p.root, nil)
+
+	e.profile.int(profileTimeNanos, p.start.UnixNano())
+	e.profile.int(profileDurationNanos, int64(p.Duration))
+	e.profile.message(profilePeriodType, e.valueType("instructions", "count"))
+	e.profile.int(profilePeriod, 1)
+	e.profile.int(profileDefaultSampleType, int64(e.string("time")))
+
+	// the locations and functions refer to the string table,
+	// so it is written once everything else is encoded
+	for _, s := range e.stringTable {
+		e.profile.bytes(profileStringTable, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	_, err := zw.Write(e.profile.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+type pprofEncoder struct {
+	profile protoBuffer
+
+	strings     map[string]int
+	stringTable []string
+
+	// functions are the ids of the functions written so far, a
+	// function and its location share the same id
+	functions map[*object.CompiledFunction]uint64
+	file      string
+}
+
+// samples writes a sample for the node and its descendants, stack are the
+// location ids of the callers of the node, the innermost caller first
+func (e *pprofEncoder) samples(node *callNode, stack []uint64) {
+	id := e.function(node)
+	stack = append([]uint64{id}, stack...)
+
+	var sample protoBuffer
+	sample.packed(sampleLocationID, stack)
+	sample.packed(sampleValue, []uint64{uint64(node.instructions), uint64(node.self), uint64(node.allocations), uint64(node.calls)})
+	e.profile.message(profileSample, &sample)
+
+	for _, child := range node.children {
+		e.samples(child, stack)
+	}
+}
+
+// function writes the function of the node and its location the first time it is seen
+func (e *pprofEncoder) function(node *callNode) uint64 {
+	if id, ok := e.functions[node.fn]; ok {
+		return id
+	}
+
+	id := uint64(len(e.functions) + 1)
+	e.functions[node.fn] = id
+
+	var startLine int64
+	if len(node.fn.Positions) > 0 {
+		startLine = int64(node.fn.Positions[0].Position.Line)
+	}
+
+	// pprof drops what is in angle brackets like C++ template arguments,
+	// <main> and <fn 1:2> are written as main and fn 1:2
+	name := strings.TrimSuffix(strings.TrimPrefix(node.name, "<"), ">")
+
+	var function protoBuffer
+	function.uint(functionID, id)
+	function.int(functionName, int64(e.string(name)))
+	function.int(functionSystemName, int64(e.string(name)))
+	function.int(functionFilename, int64(e.string(e.file)))
+	function.int(functionStartLine, startLine)
+	e.profile.message(profileFunction, &function)
+
+	var line protoBuffer
+	line.uint(lineFunctionID, id)
+	line.int(lineLine, startLine)
+
+	var location protoBuffer
+	location.uint(locationID, id)
+	location.message(locationLine, &line)
+	e.profile.message(profileLocation, &location)
+
+	return id
+}
+
+func (e *pprofEncoder) valueType(typ, unit string) *protoBuffer {
+	var valueType protoBuffer
+	valueType.int(valueTypeType, int64(e.string(typ)))
+	valueType.int(valueTypeUnit, int64(e.string(unit)))
+	return &valueType
+}
+
+// string is the index of s in the string table, the first string is always empty
+func (e *pprofEncoder) string(s string) int {
+	if index, ok := e.strings[s]; ok {
+		return index
+	}
+
+	index := len(e.stringTable)
+	e.strings[s] = index
+	e.stringTable = append(e.stringTable, s)
+	return index
+}
+
+// protoBuffer encodes the fields of a protobuf message, zero values are left out
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) tag(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+
+	b.tag(field, wireVarint)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int(field int, x int64) {
+	b.uint(field, uint64(x))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.Bytes())
+}
+
+// packed writes a repeated integer field, a sample needs all of its values even the zero ones
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var values protoBuffer
+	for _, x := range xs {
+		values.varint(x)
+	}
+
+	b.bytes(field, values.Bytes())
+}
@@ -0,0 +1,284 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/object"
+)
+
+// Profile is what the VM measured while running with profiling enabled, see
+// EnableProfiling. Besides counting the executed instructions per opcode and the
+// objects the VM created per type, it builds the call tree of the compiled functions
+// with the calls, instructions, allocations and wall time of every call stack
+type Profile struct {
+	// Duration is the wall time of the whole execution
+	Duration time.Duration
+
+	opcodes     [256]int64
+	allocations map[object.ObjectType]int64
+
+	// file is the source file of the bytecode, the pprof output refers to it
+	file string
+
+	root    *callNode
+	current *callNode
+	start   time.Time
+	// last is when the time was last charged to the current node
+	last time.Time
+}
+
+// callNode is a function in the call tree, a function called from different
+// call stacks has a node for each of them
+type callNode struct {
+	fn     *object.CompiledFunction
+	name   string
+	parent *callNode
+
+	children []*callNode
+	childFor map[*object.CompiledFunction]*callNode
+
+	calls        int64
+	instructions int64
+	allocations  int64
+	self         time.Duration
+}
+
+// FunctionProfile is what was measured for a compiled function over all of its calls
+type FunctionProfile struct {
+	Name         string
+	Calls        int64
+	Instructions int64
+	Allocations  int64
+	// Time is the wall time spent in the function and the functions it called,
+	// SelfTime only counts the time spent in the function itself
+	Time     time.Duration
+	SelfTime time.Duration
+}
+
+// EnableProfiling makes Run profile the execution, the measurements
+// are returned by Profile once Run is done
+func (vm *VM) EnableProfiling() {
+	main := vm.frames[0].cl.Fn
+
+	root := &callNode{fn: main, name: "<main>", calls: 1, childFor: map[*object.CompiledFunction]*callNode{}}
+	vm.profile = &Profile{
+		allocations: make(map[object.ObjectType]int64),
+		file:        vm.file,
+		root:        root,
+		current:     root,
+	}
+}
+
+// Profile is the profile of the execution, nil unless profiling is enabled
+func (vm *VM) Profile() *Profile {
+	return vm.profile
+}
+
+// allocated counts an object created by the VM while profiling, the object is returned as it is
+func (vm *VM) allocated(obj object.Object) object.Object {
+	if vm.profile != nil {
+		vm.profile.allocations[obj.Type()]++
+		vm.profile.current.allocations++
+	}
+
+	return obj
+}
+
+func (p *Profile) begin() {
+	p.start = time.Now()
+	p.last = p.start
+}
+
+func (p *Profile) end() {
+	p.charge()
+	p.Duration += p.last.Sub(p.start)
+}
+
+// charge adds the time since the last call or return to the function being executed
+func (p *Profile) charge() {
+	now := time.Now()
+	p.current.self += now.Sub(p.last)
+	p.last = now
+}
+
+func (p *Profile) instruction(op code.Opcode) {
+	p.opcodes[op]++
+	p.current.instructions++
+}
+
+func (p *Profile) enter(fn *object.CompiledFunction) {
+	p.charge()
+
+	node, ok := p.current.childFor[fn]
+	if !ok {
+		node = &callNode{fn: fn, name: profileName(fn), parent: p.current, childFor: map[*object.CompiledFunction]*callNode{}}
+		p.current.childFor[fn] = node
+		p.current.children = append(p.current.children, node)
+	}
+
+	node.calls++
+	p.current = node
+}
+
+func (p *Profile) leave() {
+	p.charge()
+
+	if p.current.parent != nil {
+		p.current = p.current.parent
+	}
+}
+
+// profileName tells anonymous functions apart by the position of their first instruction
+func profileName(fn *object.CompiledFunction) string {
+	if fn.Name != "" {
+		return fn.Name
+	}
+
+	if len(fn.Positions) == 0 {
+		return "<fn>"
+	}
+
+	position := fn.Positions[0].Position
+	return fmt.Sprintf("<fn %d:%d>", position.Line, position.Column)
+}
+
+// Opcodes counts the executed instructions per opcode
+func (p *Profile) Opcodes() map[code.Opcode]int64 {
+	counts := make(map[code.Opcode]int64)
+	for op, count := range p.opcodes {
+		if count > 0 {
+			counts[code.Opcode(op)] = count
+		}
+	}
+
+	return counts
+}
+
+// Allocations counts the objects the VM created per type, the values
+// the builtins return are created by the builtins and not counted
+func (p *Profile) Allocations() map[object.ObjectType]int64 {
+	counts := make(map[object.ObjectType]int64)
+	for t, count := range p.allocations {
+		counts[t] = count
+	}
+
+	return counts
+}
+
+// Functions sums up the call tree per function, the functions
+// taking the most time by themselves come first
+func (p *Profile) Functions() []FunctionProfile {
+	functions := []FunctionProfile{}
+	index := make(map[*object.CompiledFunction]int)
+	active := make(map[*object.CompiledFunction]bool)
+
+	// walk returns the time spent in the subtree of the node, the time of a recursive
+	// function is only added for its outermost call so that it is not counted twice
+	var walk func(node *callNode) time.Duration
+	walk = func(node *callNode) time.Duration {
+		i, ok := index[node.fn]
+		if !ok {
+			i = len(functions)
+			index[node.fn] = i
+			functions = append(functions, FunctionProfile{Name: node.name})
+		}
+
+		functions[i].Calls += node.calls
+		functions[i].Instructions += node.instructions
+		functions[i].Allocations += node.allocations
+		functions[i].SelfTime += node.self
+
+		outermost := !active[node.fn]
+		active[node.fn] = true
+
+		total := node.self
+		for _, child := range node.children {
+			total += walk(child)
+		}
+
+		if outermost {
+			functions[i].Time += total
+			delete(active, node.fn)
+		}
+
+		return total
+	}
+	walk(p.root)
+
+	sort.SliceStable(functions, func(i, j int) bool {
+		return functions[i].SelfTime > functions[j].SelfTime
+	})
+
+	return functions
+}
+
+// Report writes the profile as text, the functions sorted by their self time
+// and the opcodes and allocations sorted by their counts
+func (p *Profile) Report(w io.Writer) error {
+	var instructions int64
+	for _, count := range p.opcodes {
+		instructions += count
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintf(tw, "total %s, %d instructions\n\n", round(p.Duration), instructions)
+
+	fmt.Fprintf(tw, "self time\ttime\tcalls\tinstructions\tallocations\t  function\n")
+	for _, f := range p.Functions() {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t  %s\n", round(f.SelfTime), round(f.Time), f.Calls, f.Instructions, f.Allocations, f.Name)
+	}
+
+	opcodes := make(map[string]int64)
+	for op, count := range p.Opcodes() {
+		opcodes[opcodeName(op)] = count
+	}
+
+	fmt.Fprintf(tw, "\ncount\t  opcode\n")
+	for _, entry := range sortedCounts(opcodes) {
+		fmt.Fprintf(tw, "%d\t  %s\n", entry.count, entry.name)
+	}
+
+	allocations := make(map[string]int64)
+	for objectType, count := range p.allocations {
+		allocations[string(objectType)] = count
+	}
+
+	fmt.Fprintf(tw, "\ncount\t  allocations\n")
+	for _, entry := range sortedCounts(allocations) {
+		fmt.Fprintf(tw, "%d\t  %s\n", entry.count, entry.name)
+	}
+
+	return tw.Flush()
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+type countEntry struct {
+	name  string
+	count int64
+}
+
+// sortedCounts sorts the counts from the largest down, equal counts are sorted by their names
+func sortedCounts(counts map[string]int64) []countEntry {
+	entries := []countEntry{}
+	for name, count := range counts {
+		entries = append(entries, countEntry{name, count})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].count != entries[j].count {
+			return entries[i].count > entries[j].count
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	return entries
+}
@@ -0,0 +1,212 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/object"
+)
+
+const profiledProgram = `let countdown = fn(n) { if (n == 0) { 0 } else { countdown(n - 1) } };
+countdown(3);
+let pair = fn(x) { [x, x] };
+pair("a" + "b");
+fn() { 1 }();`
+
+func profile(t *testing.T, input string) *Profile {
+	t.Helper()
+
+	comp := compiler.New()
+	comp.SetOptimizations(false)
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	machine := New(comp.Bytecode())
+	if machine.Profile() != nil {
+		t.Fatalf("profiling is enabled without EnableProfiling")
+	}
+
+	machine.EnableProfiling()
+	err = machine.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	return machine.Profile()
+}
+
+func TestProfileCounts(t *testing.T) {
+	p := profile(t, profiledProgram)
+
+	opcodes := p.Opcodes()
+	expectedOpcodes := map[code.Opcode]int64{
+		code.OpCall:        3,
+		code.OpTailCall:    3,
+		code.OpReturnValue: 3,
+		code.OpClosure:     3,
+		code.OpArray:       1,
+		code.OpPop:         3,
+	}
+	for op, expected := range expectedOpcodes {
+		if opcodes[op] != expected {
+			t.Errorf("wrong count of %s. want = %d, got = %d", opcodeName(op), expected, opcodes[op])
+		}
+	}
+
+	// the constants and the small results of n - 1 are not allocated, "a" + "b" is
+	expectedAllocations := map[object.ObjectType]int64{
+		object.STRING_OBJ:  1,
+		object.ARRAY_OBJ:   1,
+		object.CLOSURE_OBJ: 3,
+	}
+	allocations := p.Allocations()
+	if len(allocations) != len(expectedAllocations) {
+		t.Errorf("wrong allocations. want = %v, got = %v", expectedAllocations, allocations)
+	}
+	for objectType, expected := range expectedAllocations {
+		if allocations[objectType] != expected {
+			t.Errorf("wrong allocations of %s. want = %d, got = %d", objectType, expected, allocations[objectType])
+		}
+	}
+
+	// integers outside of the cached range are allocated
+	large := profile(t, "2000 * 2 - 1").Allocations()
+	if large[object.INTEGER_OBJ] != 2 {
+		t.Errorf("wrong allocations of large integers. want = 2, got = %d", large[object.INTEGER_OBJ])
+	}
+
+	functions := map[string]FunctionProfile{}
+	var instructions int64
+	for _, f := range p.Functions() {
+		functions[f.Name] = f
+		instructions += f.Instructions
+	}
+
+	expectedCalls := map[string]int64{"<main>": 1, "countdown": 4, "pair": 1, "<fn 5:8>": 1}
+	if len(functions) != len(expectedCalls) {
+		t.Errorf("wrong functions. want = %v, got = %v", expectedCalls, functions)
+	}
+	for name, expected := range expectedCalls {
+		if functions[name].Calls != expected {
+			t.Errorf("wrong calls of %s. want = %d, got = %d", name, expected, functions[name].Calls)
+		}
+	}
+
+	var total int64
+	for _, count := range opcodes {
+		total += count
+	}
+	if instructions != total {
+		t.Errorf("the instructions of the functions do not add up. want = %d, got = %d", total, instructions)
+	}
+
+	if functions["pair"].Allocations != 1 || functions["<main>"].Allocations != 4 {
+		t.Errorf("wrong allocations per function. pair = %d, <main> = %d", functions["pair"].Allocations, functions["<main>"].Allocations)
+	}
+}
+
+func TestProfileTimes(t *testing.T) {
+	p := profile(t, profiledProgram)
+
+	var self time.Duration
+	functions := map[string]FunctionProfile{}
+	for _, f := range p.Functions() {
+		functions[f.Name] = f
+		self += f.SelfTime
+
+		if f.Time < f.SelfTime {
+			t.Errorf("%s: the time %s is less than the self time %s", f.Name, f.Time, f.SelfTime)
+		}
+	}
+
+	if self != p.Duration {
+		t.Errorf("the self times do not add up. want = %s, got = %s", p.Duration, self)
+	}
+
+	// the recursive calls of countdown are part of its outermost call
+	if functions["<main>"].Time != p.Duration || functions["countdown"].Time > p.Duration {
+		t.Errorf("wrong times. duration = %s, <main> = %s, countdown = %s", p.Duration, functions["<main>"].Time, functions["countdown"].Time)
+	}
+}
+
+func TestProfileReport(t *testing.T) {
+	p := profile(t, profiledProgram)
+
+	var out bytes.Buffer
+	err := p.Report(&out)
+	if err != nil {
+		t.Fatalf("report failed: %s", err)
+	}
+
+	report := out.String()
+	for _, expected := range []string{"self time", "countdown", "<fn 5:8>", "3  OpCall", "3  CLOSURE"} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("the report is missing %q.\ngot = %s", expected, report)
+		}
+	}
+
+	// equal counts are sorted by their names
+	if strings.Index(report, "OpCall") > strings.Index(report, "OpReturnValue") {
+		t.Errorf("the opcodes are not sorted.\ngot = %s", report)
+	}
+}
+
+func TestProfilePprof(t *testing.T) {
+	p := profile(t, profiledProgram)
+
+	var out bytes.Buffer
+	err := p.WritePprof(&out)
+	if err != nil {
+		t.Fatalf("writing the profile failed: %s", err)
+	}
+
+	r, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatalf("the profile is not gzipped: %s", err)
+	}
+	encoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("the profile is not gzipped: %s", err)
+	}
+
+	// the strings are in the string table as length-delimited field 6
+	for _, s := range []string{"instructions", "nanoseconds", "main", "countdown", "fn 5:8"} {
+		field := append([]byte{6<<3 | 2, byte(len(s))}, s...)
+		if !bytes.Contains(encoded, field) {
+			t.Errorf("the string table is missing %q", s)
+		}
+	}
+
+	if bytes.Contains(encoded, []byte("<main>")) {
+		t.Errorf("pprof drops the names in angle brackets, <main> has to be written as main")
+	}
+}
+
+func TestProtoBuffer(t *testing.T) {
+	tests := []struct {
+		write    func(b *protoBuffer)
+		expected []byte
+	}{
+		{func(b *protoBuffer) { b.uint(1, 150) }, []byte{0x08, 0x96, 0x01}},
+		{func(b *protoBuffer) { b.uint(1, 0) }, []byte{}},
+		{func(b *protoBuffer) { b.bytes(2, []byte("ab")) }, []byte{0x12, 0x02, 'a', 'b'}},
+		{func(b *protoBuffer) { b.packed(4, []uint64{3, 0, 270}) }, []byte{0x22, 0x04, 0x03, 0x00, 0x8e, 0x02}},
+	}
+
+	for i, tt := range tests {
+		var b protoBuffer
+		tt.write(&b)
+
+		if !bytes.Equal(b.Bytes(), tt.expected) {
+			t.Errorf("test %d: wrong encoding. want = %x, got = %x", i, tt.expected, b.Bytes())
+		}
+	}
+}
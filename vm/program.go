@@ -0,0 +1,124 @@
+package vm
+
+import (
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/object"
+)
+
+// Program is verified bytecode which is compiled once and run by any number of VMs,
+// also from different goroutines at the same time. Nothing of a program is modified
+// by running it: the constants and the compiled functions are only ever read, while
+// the stack, the frames, the globals and the closures are the state of each VM.
+// A VM on the other hand must only be used by one goroutine at a time
+type Program struct {
+	constants []object.Object
+	// main is the main program compiled as if it were the body of a function
+	main *object.CompiledFunction
+	file string
+	// globalNames name the globals in the errors of reading one which is not set
+	globalNames []string
+}
+
+// NewProgram verifies the bytecode and copies it, so the program is not changed by
+// whoever holds the bytecode, e.g. a compiler which goes on adding constants
+func NewProgram(bytecode *compiler.Bytecode) (*Program, error) {
+	err := Verify(bytecode)
+	if err != nil {
+		return nil, err
+	}
+
+	constants := make([]object.Object, len(bytecode.Constants))
+	for i, constant := range bytecode.Constants {
+		constants[i] = copyConstant(constant)
+	}
+
+	main := &object.CompiledFunction{
+		Instructions: copyInstructions(bytecode.Instructions),
+		Positions:    copyPositions(bytecode.Positions),
+	}
+
+	return &Program{
+		constants:   constants,
+		main:        main,
+		file:        bytecode.File,
+		globalNames: copyNames(bytecode.GlobalNames),
+	}, nil
+}
+
+// newProgram wraps the bytecode without verifying or copying it, for New
+func newProgram(bytecode *compiler.Bytecode) *Program {
+	main := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		Positions:    bytecode.Positions,
+	}
+
+	return &Program{
+		constants:   bytecode.Constants,
+		main:        main,
+		file:        bytecode.File,
+		globalNames: bytecode.GlobalNames,
+	}
+}
+
+// NewVM creates a VM running the program, only its own small stack and frames are
+// allocated, the globals are allocated as the program binds them. The options
+// size them just like for New
+func (p *Program) NewVM(options ...Option) *VM {
+	mainFrame := NewFrame(&object.Closure{Fn: p.main}, 0)
+
+	vm := &VM{
+		constants:    p.constants,
+		stack:        make([]object.Object, InitialStackSize),
+		maxStackSize: StackSize,
+		sp:           0,
+		frames:       []*Frame{mainFrame},
+		maxFrames:    MaxFrames,
+		maxGlobals:   GlobalsSize,
+		framesIndex:  1,
+		file:         p.file,
+		globalNames:  p.globalNames,
+	}
+
+	for _, option := range options {
+		option(vm)
+	}
+
+	// the stack never starts out larger than it may grow
+	if len(vm.stack) > vm.maxStackSize {
+		vm.stack = vm.stack[:vm.maxStackSize]
+	}
+
+	return vm
+}
+
+// copyConstant copies the constants the compiler creates, the values of other
+// types are never created by the compiler and are kept as they are
+func copyConstant(constant object.Object) object.Object {
+	switch constant := constant.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: constant.Value}
+	case *object.String:
+		return &object.String{Value: constant.Value}
+	case *object.CompiledFunction:
+		fn := *constant
+		fn.Instructions = copyInstructions(constant.Instructions)
+		fn.Positions = copyPositions(constant.Positions)
+		fn.LocalNames = copyNames(constant.LocalNames)
+		return &fn
+	default:
+		return constant
+	}
+}
+
+func copyInstructions(ins code.Instructions) code.Instructions {
+	return append(code.Instructions{}, ins...)
+}
+
+func copyPositions(positions code.PositionTable) code.PositionTable {
+	return append(code.PositionTable{}, positions...)
+}
+
+func copyNames(names []string) []string {
+	return append([]string{}, names...)
+}
@@ -0,0 +1,148 @@
+package vm
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/object"
+)
+
+func TestProgramRunsInParallel(t *testing.T) {
+	input := `
+	let adder = fn(x) { fn(y) { x + y } };
+	let map = fn(arr, f) {
+		let iter = fn(arr, acc) {
+			if (len(arr) == 0) { acc } else { iter(rest(arr), push(acc, f(first(arr)))) }
+		};
+		iter(arr, [])
+	};
+	let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+	let names = {"one": 1, "two": 2};
+	let numbers = map([1, 2, 3], adder(names["two"]));
+	[fib(15), numbers, "hello" + " " + "world"]
+	`
+
+	program, err := NewProgram(compile(t, input))
+	if err != nil {
+		t.Fatalf("program error: %s", err)
+	}
+
+	expected := `[610, [3, 4, 5], hello world]`
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for run := 0; run < 10; run++ {
+				// the profile is state of the VM just like its stack
+				vm := program.NewVM(WithInitialStackSize(8))
+				if i%2 == 0 {
+					vm.EnableProfiling()
+				}
+
+				err := vm.Run()
+				if err != nil {
+					t.Errorf("vm error: %s", err)
+					return
+				}
+
+				result := vm.LastPoppedStackElem().Inspect()
+				if result != expected {
+					t.Errorf("wrong result. want = %s, got = %s", expected, result)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestProgramCopiesBytecode(t *testing.T) {
+	bytecode := compile(t, `let f = fn() { "a" }; f() + "b"`)
+
+	program, err := NewProgram(bytecode)
+	if err != nil {
+		t.Fatalf("program error: %s", err)
+	}
+
+	// whoever holds the bytecode can change it without changing the program
+	for i, constant := range bytecode.Constants {
+		switch constant := constant.(type) {
+		case *object.String:
+			constant.Value = "changed"
+		case *object.CompiledFunction:
+			bytecode.Constants[i] = &object.CompiledFunction{Instructions: code.Make(code.OpNull)}
+		}
+	}
+	bytecode.Instructions = code.Instructions{}
+
+	vm := program.NewVM()
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, "ab", vm.LastPoppedStackElem())
+}
+
+func TestProgramVerifiesBytecode(t *testing.T) {
+	bytecode := &compiler.Bytecode{
+		Instructions: code.Make(code.OpConstant, 1),
+		Constants:    []object.Object{&object.Integer{Value: 1}},
+	}
+
+	_, err := NewProgram(bytecode)
+	if err == nil {
+		t.Fatalf("expected an error for invalid bytecode")
+	}
+}
+
+func TestNewVMIsCheap(t *testing.T) {
+	program, err := NewProgram(compile(t, "let a = 1; a + 2"))
+	if err != nil {
+		t.Fatalf("program error: %s", err)
+	}
+
+	const runs = 100
+	vms := make([]*VM, runs)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := range vms {
+		vms[i] = program.NewVM()
+	}
+	runtime.ReadMemStats(&after)
+
+	// the initial stack takes most of it, the globals are only allocated once they are bound
+	perVM := (after.TotalAlloc - before.TotalAlloc) / runs
+	if perVM > 4096 {
+		t.Errorf("NewVM allocates too much. got = %d bytes", perVM)
+	}
+}
+
+func BenchmarkNewVM(b *testing.B) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let a = 1; a + 2"))
+	if err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+
+	program, err := NewProgram(comp.Bytecode())
+	if err != nil {
+		b.Fatalf("program error: %s", err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vm := program.NewVM()
+		err := vm.Run()
+		if err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"fmt"
+
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/object"
+)
+
+// Verify checks the bytecode before it is run, which matters for bytecode loaded
+// from a file or assembled by hand. The main program and the compiled functions are
+// checked with code.Verify, and every OpClosure has to create a closure of a compiled
+// function with the same number of free variables wherever the function is closed over.
+// A function which is never closed over can not be called and is not checked, the
+// optimizer leaves such functions behind when it removes unreachable code
+func Verify(bytecode *compiler.Bytecode) error {
+	limits := code.Limits{
+		Constants: len(bytecode.Constants),
+		Globals:   GlobalsSize,
+		Builtins:  len(object.Builtins),
+	}
+
+	err := code.Verify(bytecode.Instructions, limits)
+	if err != nil {
+		return fmt.Errorf("main: %s", err)
+	}
+
+	// the number of free variables of a function is known from the OpClosure
+	// instructions closing over it, they are followed from the main program
+	numFree := make(map[int]int)
+	worklist := []code.Instructions{bytecode.Instructions}
+	names := []string{"main"}
+
+	for len(worklist) > 0 {
+		ins, name := worklist[0], names[0]
+		worklist, names = worklist[1:], names[1:]
+
+		for _, closure := range closures(ins) {
+			constIndex, free := closure[0], closure[1]
+
+			fn, ok := bytecode.Constants[constIndex].(*object.CompiledFunction)
+			if !ok {
+				return fmt.Errorf("%s: OpClosure of constant %d which is %s, not a compiled function",
+					name, constIndex, bytecode.Constants[constIndex].Type())
+			}
+
+			if seen, ok := numFree[constIndex]; ok {
+				if seen != free {
+					return fmt.Errorf("%s: OpClosure of constant %d with %d free variables, %d elsewhere",
+						name, constIndex, free, seen)
+				}
+				continue
+			}
+			numFree[constIndex] = free
+
+			err := verifyFunction(fn, constIndex, free, limits)
+			if err != nil {
+				return err
+			}
+
+			worklist = append(worklist, fn.Instructions)
+			names = append(names, fmt.Sprintf("constant %d", constIndex))
+		}
+	}
+
+	return nil
+}
+
+func verifyFunction(fn *object.CompiledFunction, constIndex, numFree int, limits code.Limits) error {
+	if fn.NumParameters > fn.NumLocals {
+		return fmt.Errorf("constant %d: %d parameters but only %d locals", constIndex, fn.NumParameters, fn.NumLocals)
+	}
+
+	limits.Locals = fn.NumLocals
+	limits.Free = numFree
+	limits.Function = true
+
+	err := code.Verify(fn.Instructions, limits)
+	if err != nil {
+		return fmt.Errorf("constant %d: %s", constIndex, err)
+	}
+
+	return nil
+}
+
+// closures lists the constant index and number of free variables of every OpClosure,
+// the instructions have to be verified already
+func closures(ins code.Instructions) [][2]int {
+	found := [][2]int{}
+
+	for offset := 0; offset < len(ins); {
+		def, _ := code.Lookup(ins[offset])
+		operands, read := code.ReadOperands(def, ins[offset+1:])
+
+		switch code.Opcode(ins[offset]) {
+		case code.OpClosure, code.OpClosureWide:
+			found = append(found, [2]int{operands[0], operands[1]})
+		}
+
+		offset += 1 + read
+	}
+
+	return found
+}
@@ -0,0 +1,126 @@
+package vm
+
+import (
+	"testing"
+
+	"lookageek.com/ode/code"
+	"lookageek.com/ode/compiler"
+	"lookageek.com/ode/object"
+)
+
+func TestVerify(t *testing.T) {
+	// returns its free variable, closed over with one free variable by a closure
+	inner := &object.CompiledFunction{
+		Instructions: concatInstructions(code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue)),
+	}
+
+	tests := []struct {
+		name     string
+		bytecode *compiler.Bytecode
+		expected string
+	}{
+		{
+			"closure",
+			&compiler.Bytecode{
+				Instructions: concatInstructions(
+					code.Make(code.OpTrue),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpPop),
+				),
+				Constants: []object.Object{inner},
+			},
+			"",
+		},
+		{
+			"closure created by a function",
+			&compiler.Bytecode{
+				Instructions: concatInstructions(code.Make(code.OpClosure, 1, 0), code.Make(code.OpPop)),
+				Constants: []object.Object{
+					inner,
+					&object.CompiledFunction{
+						Instructions: concatInstructions(
+							code.Make(code.OpTrue),
+							code.Make(code.OpClosure, 0, 1),
+							code.Make(code.OpReturnValue),
+						),
+					},
+				},
+			},
+			"",
+		},
+		{
+			"function which is never closed over",
+			&compiler.Bytecode{
+				Instructions: code.Make(code.OpNull),
+				Constants:    []object.Object{inner},
+			},
+			"",
+		},
+		{
+			"error in the main program",
+			&compiler.Bytecode{Instructions: code.Make(code.OpConstant, 0)},
+			"main: offset 0000: OpConstant constant 0 out of range, there are 0",
+		},
+		{
+			"closure of a constant which is not a function",
+			&compiler.Bytecode{
+				Instructions: code.Make(code.OpClosure, 0, 0),
+				Constants:    []object.Object{&object.Integer{Value: 1}},
+			},
+			"main: OpClosure of constant 0 which is INTEGER, not a compiled function",
+		},
+		{
+			"free variables the closure does not capture",
+			&compiler.Bytecode{
+				Instructions: concatInstructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+				Constants:    []object.Object{inner},
+			},
+			"constant 0: offset 0000: OpGetFree free variable 0 out of range, there are 0",
+		},
+		{
+			"closures with different free variables",
+			&compiler.Bytecode{
+				Instructions: concatInstructions(
+					code.Make(code.OpTrue),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpClosure, 0, 0),
+				),
+				Constants: []object.Object{inner},
+			},
+			"main: OpClosure of constant 0 with 0 free variables, 1 elsewhere",
+		},
+		{
+			"function running past its end",
+			&compiler.Bytecode{
+				Instructions: concatInstructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+				Constants: []object.Object{
+					&object.CompiledFunction{Instructions: code.Make(code.OpNull)},
+				},
+			},
+			"constant 0: offset 0000: function runs past its last instruction",
+		},
+		{
+			"more parameters than locals",
+			&compiler.Bytecode{
+				Instructions: code.Make(code.OpClosure, 0, 0),
+				Constants: []object.Object{
+					&object.CompiledFunction{Instructions: code.Make(code.OpReturn), NumParameters: 1},
+				},
+			},
+			"constant 0: 1 parameters but only 0 locals",
+		},
+	}
+
+	for _, tt := range tests {
+		err := Verify(tt.bytecode)
+
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+
+		if got != tt.expected {
+			t.Errorf("%s: wrong error. want = %q, got = %q", tt.name, tt.expected, got)
+		}
+	}
+}
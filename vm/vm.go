@@ -1,29 +1,92 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+
+	"lookageek.com/ode/budget"
 	"lookageek.com/ode/code"
 	"lookageek.com/ode/compiler"
 	"lookageek.com/ode/object"
 )
 
+// StackSize is the number of values the stack can grow to unless WithMaxStackSize says otherwise
 const StackSize = 2048
 
+// MaxFrames is the deepest the calls can be nested unless WithMaxFrames says otherwise
+const MaxFrames = 1024
+
+// GlobalsSize is the number of globals the store can grow to unless WithGlobalsSize says
+// otherwise, it is the largest index the 2 byte operand of OpSetGlobal can hold
+const GlobalsSize = 65536
+
+// infixOperators maps the infix opcodes back to the ode operator they were
+// compiled from, so runtime errors read the same as the evaluator's
+var infixOperators = map[code.Opcode]string{
+	code.OpAdd:         "+",
+	code.OpSub:         "-",
+	code.OpMul:         "*",
+	code.OpDiv:         "/",
+	code.OpEqual:       "==",
+	code.OpNotEqual:    "!=",
+	code.OpGreaterThan: ">",
+	code.OpLessThan:    "<",
+}
+
+// fusedOperations maps the superinstructions to the arithmetic opcode they perform
+var fusedOperations = map[code.Opcode]code.Opcode{
+	code.OpAddConstant: code.OpAdd,
+	code.OpSubConstant: code.OpSub,
+}
+
+// VM is the state of a single run of a program, it is not safe for concurrent use
 type VM struct {
-	constants    []object.Object
-	instructions code.Instructions
+	// constants are shared by all VMs running the same program and are never modified
+	constants []object.Object
+	// stack grows up to maxStackSize values, see growStack
 	stack        []object.Object
+	maxStackSize int
 	// Always points to the next value. Top of stack is stack[sp-1]
 	sp int
+
+	// globals grows up to maxGlobals values as the program binds them, see growGlobals
+	globals    []object.Object
+	maxGlobals int
+
+	// frames grows up to maxFrames frames
+	frames    []*Frame
+	maxFrames int
+	// framesIndex points to the next free frame, current frame is frames[framesIndex-1]
+	framesIndex int
+
+	// file is the source file of the bytecode, used to locate runtime errors
+	file string
+	// globalNames are the names of the globals by slot, shared with the program
+	globalNames []string
+
+	debugger Debugger
+	// profile is nil unless profiling is enabled
+	profile *Profile
+
+	limits budget.Limits
+	// budget is nil when the execution is neither limited nor cancellable
+	budget *budget.Budget
 }
 
-func New(bytecode *compiler.Bytecode) *VM {
-	return &VM{
-		instructions: bytecode.Instructions,
-		constants:    bytecode.Constants,
-		stack:        make([]object.Object, StackSize),
-		sp:           0,
-	}
+// New creates a VM running the bytecode, the options size its stack, frames and globals.
+// The VM shares the bytecode without verifying it, see NewProgram for running
+// verified bytecode from several goroutines
+func New(bytecode *compiler.Bytecode, options ...Option) *VM {
+	return newProgram(bytecode).NewVM(options...)
+}
+
+// NewWithGlobalsStore creates a VM which starts out with an existing globals store. The
+// store grows when the program binds more globals than it holds, the REPL passes the
+// store Globals returns after a line to the VM of the next line so bindings survive
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object, options ...Option) *VM {
+	// the store is set as the last option so New does not allocate another one
+	options = append(options[:len(options):len(options)], func(vm *VM) { vm.globals = s })
+	return New(bytecode, options...)
 }
 
 func (vm *VM) StackTop() object.Object {
@@ -34,27 +97,469 @@ func (vm *VM) StackTop() object.Object {
 	return vm.stack[vm.sp-1]
 }
 
+// LastPoppedStackElem returns the element which was just popped off the stack,
+// since every expression statement ends in an OpPop this is the value of the
+// last evaluated expression. pop only decrements sp so the element is still there
+func (vm *VM) LastPoppedStackElem() object.Object {
+	if vm.sp >= len(vm.stack) {
+		return nil
+	}
+
+	return vm.stack[vm.sp]
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= vm.maxFrames {
+		return fmt.Errorf("%w: calls are nested more than %d frames deep", ErrStackOverflow, vm.maxFrames)
+	}
+
+	if vm.framesIndex == len(vm.frames) {
+		vm.frames = append(vm.frames, f)
+	} else {
+		vm.frames[vm.framesIndex] = f
+	}
+	vm.framesIndex++
+	return nil
+}
+
+func (vm *VM) popFrame() *Frame {
+	if vm.profile != nil {
+		vm.profile.leave()
+	}
+
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
+}
+
+// clearLastPopped forgets the element which was just popped off the stack. A let
+// statement is not an expression and produces no value, as in the evaluator
+func (vm *VM) clearLastPopped() {
+	vm.stack[vm.sp] = nil
+}
+
+// SetLimits limits the instructions, the nested calls and the wall time of Run
+func (vm *VM) SetLimits(limits budget.Limits) {
+	vm.limits = limits
+}
+
+// Run executes the bytecode, a failure is returned as a *RuntimeError
 func (vm *VM) Run() error {
-	for ip := 0; ip < len(vm.instructions); ip++ {
-		op := code.Opcode(vm.instructions[ip])
+	return vm.RunContext(context.Background())
+}
+
+// RunContext is Run which stops once ctx is done, the RuntimeError
+// then wraps the error of the context
+func (vm *VM) RunContext(ctx context.Context) error {
+	vm.budget = nil
+	if ctx.Done() != nil || vm.limits != (budget.Limits{}) {
+		vm.budget = budget.New(ctx, vm.limits)
+	}
+
+	if vm.profile != nil {
+		vm.profile.begin()
+		defer vm.profile.end()
+	}
+
+	err := vm.run()
+	if err != nil {
+		return vm.runtimeError(err)
+	}
+
+	return nil
+}
+
+// run executes the instructions until the main program ends, an error is
+// returned as an *instructionError of the instruction which failed
+func (vm *VM) run() (err error) {
+	var ip int
+	var ins code.Instructions
+	var op code.Opcode
+
+	defer func() {
+		if err != nil {
+			err = &instructionError{op: op, offset: ip, err: err}
+		}
+	}()
+
+	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		vm.currentFrame().ip++
+
+		ip = vm.currentFrame().ip
+		ins = vm.currentFrame().Instructions()
+		op = code.Opcode(ins[ip])
+
+		if vm.debugger != nil {
+			err := vm.debugger.Step(vm)
+			if err != nil {
+				return err
+			}
+		}
+
+		if vm.profile != nil {
+			vm.profile.instruction(op)
+		}
+
+		if vm.budget != nil {
+			err := vm.budget.Step()
+			if err != nil {
+				return err
+			}
+		}
+
+		err := vm.checkInstruction(op, ins, ip)
+		if err != nil {
+			return err
+		}
 
 		switch op {
 		case code.OpConstant:
-			constIndex := code.ReadUInt16(vm.instructions[ip+1:])
-			ip += 2
-			err := vm.push(vm.constants[constIndex])
+			constIndex := int(code.ReadUInt16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			err := vm.pushConstant(constIndex)
+			if err != nil {
+				return err
+			}
+
+		case code.OpConstantWide:
+			constIndex := int(code.ReadUint32(ins[ip+1:]))
+			vm.currentFrame().ip += 4
+
+			err := vm.pushConstant(constIndex)
+			if err != nil {
+				return err
+			}
+
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+			err := vm.executeBinaryOperation(op)
+			if err != nil {
+				return err
+			}
+
+		case code.OpAddConstant, code.OpSubConstant:
+			constIndex := int(code.ReadUInt16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			err := vm.checkConstant(constIndex)
+			if err != nil {
+				return err
+			}
+
+			left := vm.pop()
+			right := vm.constants[constIndex]
+
+			err = vm.binaryOperation(fusedOperations[op], left, right)
+			if err != nil {
+				return err
+			}
+
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan:
+			err := vm.executeComparison(op)
+			if err != nil {
+				return err
+			}
+
+		case code.OpTrue:
+			err := vm.push(object.TRUE)
+			if err != nil {
+				return err
+			}
+
+		case code.OpFalse:
+			err := vm.push(object.FALSE)
 			if err != nil {
 				return err
 			}
 
-		case code.OpAdd:
-			right := vm.pop()
+		case code.OpBang:
+			err := vm.executeBangOperator()
+			if err != nil {
+				return err
+			}
+
+		case code.OpMinus:
+			err := vm.executeMinusOperator()
+			if err != nil {
+				return err
+			}
+
+		case code.OpPop:
+			vm.pop()
+
+		case code.OpJump:
+			pos := int(code.ReadUInt16(ins[ip+1:]))
+			// the loop increments ip, so land right before the target
+			vm.currentFrame().ip = pos - 1
+
+		case code.OpJumpNotTruthy:
+			pos := int(code.ReadUInt16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			condition := vm.pop()
+			if !isTruthy(condition) {
+				vm.currentFrame().ip = pos - 1
+			}
+
+		case code.OpNull:
+			err := vm.push(object.NULL)
+			if err != nil {
+				return err
+			}
+
+		case code.OpSetGlobal:
+			globalIndex := code.ReadUInt16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.growGlobals(int(globalIndex))
+			if err != nil {
+				return err
+			}
+
+			vm.globals[globalIndex] = vm.pop()
+			vm.clearLastPopped()
+
+		case code.OpGetGlobal:
+			globalIndex := code.ReadUInt16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.checkGlobal(int(globalIndex))
+			if err != nil {
+				return err
+			}
+
+			// a global is unset when it is not bound yet or the line of the REPL binding it failed
+			var global object.Object
+			if int(globalIndex) < len(vm.globals) {
+				global = vm.globals[globalIndex]
+			}
+			if global == nil {
+				return fmt.Errorf("%s is %w", bindingName("global", vm.globalNames, int(globalIndex)), ErrUnset)
+			}
+
+			err = vm.push(global)
+			if err != nil {
+				return err
+			}
+
+		case code.OpArray:
+			numElements := int(code.ReadUInt16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			err := vm.checkStack(numElements)
+			if err != nil {
+				return err
+			}
+
+			array := vm.buildArray(vm.sp-numElements, vm.sp)
+			vm.sp = vm.sp - numElements
+
+			err = vm.push(array)
+			if err != nil {
+				return err
+			}
+
+		case code.OpHash:
+			numElements := int(code.ReadUInt16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			if numElements%2 != 0 {
+				return fmt.Errorf("hash of %d elements, keys and values have to pair up", numElements)
+			}
+
+			err := vm.checkStack(numElements)
+			if err != nil {
+				return err
+			}
+
+			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
+			if err != nil {
+				return err
+			}
+			vm.sp = vm.sp - numElements
+
+			err = vm.push(hash)
+			if err != nil {
+				return err
+			}
+
+		case code.OpIndex:
+			index := vm.pop()
 			left := vm.pop()
-			leftValue := left.(*object.Integer).Value
-			rightValue := right.(*object.Integer).Value
 
-			result := leftValue + rightValue
-			vm.push(&object.Integer{Value: result})
+			err := vm.executeIndexExpression(left, index)
+			if err != nil {
+				return err
+			}
+
+		case code.OpCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			// the callee sits below its arguments
+			err := vm.checkStack(int(numArgs) + 1)
+			if err != nil {
+				return err
+			}
+
+			err = vm.executeCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.checkStack(int(numArgs) + 1)
+			if err != nil {
+				return err
+			}
+
+			err = vm.executeTailCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+
+		case code.OpReturnValue:
+			returnValue := vm.pop()
+
+			// a return statement in the main program ends the execution, the
+			// returned value is left as the last popped element
+			if vm.framesIndex == 1 {
+				return nil
+			}
+
+			frame := vm.popFrame()
+			// the extra -1 also removes the called function off the stack
+			vm.sp = frame.basePointer - 1
+
+			err := vm.push(returnValue)
+			if err != nil {
+				return err
+			}
+
+		case code.OpReturn:
+			// like OpReturnValue in the main program, with null as its value
+			if vm.framesIndex == 1 {
+				err := vm.growStack(vm.sp + 1)
+				if err != nil {
+					return err
+				}
+
+				vm.stack[vm.sp] = object.NULL
+				return nil
+			}
+
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+
+			err := vm.push(object.NULL)
+			if err != nil {
+				return err
+			}
+
+		case code.OpSetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.checkLocal(int(localIndex))
+			if err != nil {
+				return err
+			}
+
+			frame := vm.currentFrame()
+			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+			vm.clearLastPopped()
+
+		case code.OpGetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.checkLocal(int(localIndex))
+			if err != nil {
+				return err
+			}
+
+			// a local is unset when the let statement binding it was not executed
+			local := vm.stack[vm.currentFrame().basePointer+int(localIndex)]
+			if local == nil {
+				localNames := vm.currentFrame().cl.Fn.LocalNames
+				return fmt.Errorf("%s is %w", bindingName("local", localNames, int(localIndex)), ErrUnset)
+			}
+
+			err = vm.push(local)
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetBuiltin:
+			builtinIndex := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			if builtinIndex >= len(object.Builtins) {
+				return fmt.Errorf("builtin %d out of range, there are %d builtins", builtinIndex, len(object.Builtins))
+			}
+			definition := object.Builtins[builtinIndex]
+
+			err := vm.push(definition.Builtin)
+			if err != nil {
+				return err
+			}
+
+		case code.OpClosure:
+			constIndex := code.ReadUInt16(ins[ip+1:])
+			numFree := code.ReadUint8(ins[ip+3:])
+			vm.currentFrame().ip += 3
+
+			err := vm.checkStack(int(numFree))
+			if err != nil {
+				return err
+			}
+
+			err = vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+
+		case code.OpClosureWide:
+			constIndex := code.ReadUint32(ins[ip+1:])
+			numFree := code.ReadUint8(ins[ip+5:])
+			vm.currentFrame().ip += 5
+
+			err := vm.checkStack(int(numFree))
+			if err != nil {
+				return err
+			}
+
+			err = vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetFree:
+			freeIndex := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			if freeIndex >= len(currentClosure.Free) {
+				return fmt.Errorf("free variable %d out of range, the closure has %d", freeIndex, len(currentClosure.Free))
+			}
+
+			err := vm.push(currentClosure.Free[freeIndex])
+			if err != nil {
+				return err
+			}
+
+		case code.OpCurrentClosure:
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(currentClosure)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -62,8 +567,11 @@ func (vm *VM) Run() error {
 }
 
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+	if vm.sp >= len(vm.stack) {
+		err := vm.growStack(vm.sp + 1)
+		if err != nil {
+			return err
+		}
 	}
 
 	vm.stack[vm.sp] = o
@@ -72,8 +580,412 @@ func (vm *VM) push(o object.Object) error {
 	return nil
 }
 
+// pushConstant pushes the constant at index in the constant pool
+func (vm *VM) pushConstant(index int) error {
+	err := vm.checkConstant(index)
+	if err != nil {
+		return err
+	}
+
+	return vm.push(vm.constants[index])
+}
+
+// pop takes the top value off the stack, the instructions check
+// the depth of the stack before they pop, see checkInstruction
 func (vm *VM) pop() object.Object {
 	o := vm.stack[vm.sp-1]
 	vm.sp--
 	return o
-}
\ No newline at end of file
+}
+
+// executeCall calls the function or builtin sitting below its numArgs arguments on the stack
+func (vm *VM) executeCall(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+
+	switch callee := callee.(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	default:
+		return newOperandError([]object.Object{callee}, "not a function: %s", callee.Type())
+	}
+}
+
+// callClosure executes the function of the closure in a new frame. The arguments already
+// are in the first local slots of the new frame, the remaining locals are reserved by
+// moving the stack pointer above them
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
+	if numArgs != cl.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want = %d, got = %d", cl.Fn.NumParameters, numArgs)
+	}
+
+	// the main program is not a call, the frames above it are
+	if vm.budget != nil {
+		err := vm.budget.Call(vm.framesIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	frame := NewFrame(cl, vm.sp-numArgs)
+	err := vm.growStack(frame.basePointer + cl.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
+
+	err = vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	// the slots of the locals still hold the values of earlier calls, which
+	// must not show up as the locals of this call before they are set
+	top := frame.basePointer + cl.Fn.NumLocals
+	for i := vm.sp; i < top; i++ {
+		vm.stack[i] = nil
+	}
+	vm.sp = top
+
+	if vm.profile != nil {
+		vm.profile.enter(cl.Fn)
+	}
+
+	return nil
+}
+
+// executeTailCall calls a closure in the frame of the current function, which
+// is done once the call returns. The callee and its arguments are moved down
+// onto the callee and the arguments of the current call, so tail recursion
+// runs in constant stack space. Builtins are called like OpCall calls them
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok || vm.framesIndex == 1 {
+		return vm.executeCall(numArgs)
+	}
+
+	if numArgs != cl.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want = %d, got = %d", cl.Fn.NumParameters, numArgs)
+	}
+
+	frame := vm.currentFrame()
+	err := vm.growStack(frame.basePointer + cl.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
+
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+
+	// the locals of the current function must not show up as the locals of the called one
+	top := frame.basePointer + cl.Fn.NumLocals
+	for i := frame.basePointer + numArgs; i < top; i++ {
+		vm.stack[i] = nil
+	}
+	vm.sp = top
+
+	frame.cl = cl
+	frame.ip = -1
+
+	if vm.profile != nil {
+		vm.profile.leave()
+		vm.profile.enter(cl.Fn)
+	}
+
+	return nil
+}
+
+// pushClosure wraps the compiled function constant into a closure, capturing
+// the numFree values on top of the stack as its free variables
+func (vm *VM) pushClosure(constIndex int, numFree int) error {
+	err := vm.checkConstant(constIndex)
+	if err != nil {
+		return err
+	}
+
+	constant := vm.constants[constIndex]
+	function, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return newOperandError([]object.Object{constant}, "not a function: %s", constant.Type())
+	}
+
+	free := make([]object.Object, numFree)
+	for i := 0; i < numFree; i++ {
+		free[i] = vm.stack[vm.sp-numFree+i]
+	}
+	vm.sp = vm.sp - numFree
+
+	closure := &object.Closure{Fn: function, Free: free}
+	return vm.push(vm.allocated(closure))
+}
+
+// callBuiltin runs the Go function of the builtin directly, then replaces
+// the builtin and its arguments on the stack with the result
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp]
+
+	result := builtin.Fn(args...)
+	vm.sp = vm.sp - numArgs - 1
+
+	// an error returned by a builtin stops the execution, the same
+	// way an error object stops the evaluator
+	if errObj, ok := result.(*object.Error); ok {
+		return fmt.Errorf("%s", errObj.Message)
+	}
+
+	if result != nil {
+		return vm.push(result)
+	}
+
+	return vm.push(object.NULL)
+}
+
+// executeBinaryOperation pops the two operands of an arithmetic opcode
+// and pushes the result, integers support all arithmetic and strings only "+"
+func (vm *VM) executeBinaryOperation(op code.Opcode) error {
+	right := vm.pop()
+	left := vm.pop()
+
+	return vm.binaryOperation(op, left, right)
+}
+
+// binaryOperation pushes the result of the arithmetic opcode on the two operands
+func (vm *VM) binaryOperation(op code.Opcode, left, right object.Object) error {
+	leftType := left.Type()
+	rightType := right.Type()
+
+	switch {
+	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
+		return vm.executeBinaryIntegerOperation(op, left, right)
+	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
+		return vm.executeBinaryStringOperation(op, left, right)
+	default:
+		return operatorError(op, left, right)
+	}
+}
+
+func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.Object) error {
+	leftValue := left.(*object.Integer).Value
+	rightValue := right.(*object.Integer).Value
+
+	var result int64
+
+	switch op {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = leftValue / rightValue
+	default:
+		return fmt.Errorf("unknown integer operator: %d", op)
+	}
+
+	return vm.push(vm.integer(result))
+}
+
+// executeBinaryStringOperation concatenates two strings, the only operator supported for strings
+func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
+	if op != code.OpAdd {
+		return operatorError(op, left, right)
+	}
+
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	return vm.push(vm.allocated(&object.String{Value: leftValue + rightValue}))
+}
+
+// executeComparison pops the two operands of a comparison opcode and pushes
+// the boolean result, integers are compared by value and everything
+// else by identity which works because booleans are singletons.
+// Like in the evaluator, strings can not be compared at all
+func (vm *VM) executeComparison(op code.Opcode) error {
+	right := vm.pop()
+	left := vm.pop()
+
+	leftType := left.Type()
+	rightType := right.Type()
+
+	switch {
+	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
+		return vm.executeIntegerComparison(op, left, right)
+	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
+		return operatorError(op, left, right)
+	case op == code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(right == left))
+	case op == code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(right != left))
+	default:
+		return operatorError(op, left, right)
+	}
+}
+
+// operatorError is the error for an infix opcode which does not support its operands,
+// the messages are the same ones evaluator.evalInfixExpression produces
+func operatorError(op code.Opcode, left, right object.Object) error {
+	operands := []object.Object{left, right}
+
+	if left.Type() != right.Type() {
+		return newOperandError(operands, "type mismatch: %s %s %s", left.Type(), infixOperators[op], right.Type())
+	}
+
+	return newOperandError(operands, "unknown operator: %s %s %s", left.Type(), infixOperators[op], right.Type())
+}
+
+func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object) error {
+	leftValue := left.(*object.Integer).Value
+	rightValue := right.(*object.Integer).Value
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+// executeBangOperator negates the operand, everything other than
+// false and null is truthy so negates to false
+func (vm *VM) executeBangOperator() error {
+	operand := vm.pop()
+
+	switch operand {
+	case object.TRUE:
+		return vm.push(object.FALSE)
+	case object.FALSE:
+		return vm.push(object.TRUE)
+	case object.NULL:
+		return vm.push(object.TRUE)
+	default:
+		return vm.push(object.FALSE)
+	}
+}
+
+// executeMinusOperator negates an integer operand, it is an error for any other type
+func (vm *VM) executeMinusOperator() error {
+	operand := vm.pop()
+
+	if operand.Type() != object.INTEGER_OBJ {
+		return newOperandError([]object.Object{operand}, "unknown operator: -%s", operand.Type())
+	}
+
+	value := operand.(*object.Integer).Value
+	return vm.push(vm.integer(-value))
+}
+
+// isTruthy follows the evaluator, only false and null are not truthy
+func isTruthy(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func nativeBoolToBooleanObject(input bool) *object.Boolean {
+	if input {
+		return object.TRUE
+	}
+
+	return object.FALSE
+}
+
+// integer is the integer object of the value, only integers outside
+// of the cached range are allocated and counted by the profile
+func (vm *VM) integer(value int64) object.Object {
+	if object.IsCachedInteger(value) {
+		return object.NewInteger(value)
+	}
+
+	return vm.allocated(&object.Integer{Value: value})
+}
+
+// buildArray creates an array out of the stack elements between startIndex and endIndex
+func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
+	elements := make([]object.Object, endIndex-startIndex)
+
+	for i := startIndex; i < endIndex; i++ {
+		elements[i-startIndex] = vm.stack[i]
+	}
+
+	return vm.allocated(&object.Array{Elements: elements})
+}
+
+// buildHash creates a hash out of the stack elements between startIndex and endIndex,
+// which alternate between a key and its value
+func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
+	hashedPairs := make(map[object.HashKey]object.HashPair)
+
+	for i := startIndex; i < endIndex; i += 2 {
+		key := vm.stack[i]
+		value := vm.stack[i+1]
+
+		pair := object.HashPair{Key: key, Value: value}
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, newOperandError([]object.Object{key}, "unusable value as hash key: %s", key.Type())
+		}
+
+		hashedPairs[hashKey.HashKey()] = pair
+	}
+
+	return vm.allocated(&object.Hash{Pairs: hashedPairs}), nil
+}
+
+// executeIndexExpression supports indexing arrays with integers and hashes with any
+// hashable key, following the same rules as the evaluator
+func (vm *VM) executeIndexExpression(left, index object.Object) error {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.HASH_OBJ:
+		return vm.executeHashIndex(left, index)
+	default:
+		return newOperandError([]object.Object{left, index}, "index operator not supported: %s", left.Type())
+	}
+}
+
+// executeArrayIndex pushes null for an index which is out of bounds
+func (vm *VM) executeArrayIndex(array, index object.Object) error {
+	arrayObject := array.(*object.Array)
+	i := index.(*object.Integer).Value
+	max := int64(len(arrayObject.Elements) - 1)
+
+	if i < 0 || i > max {
+		return vm.push(object.NULL)
+	}
+
+	return vm.push(arrayObject.Elements[i])
+}
+
+// executeHashIndex pushes null for a key which is not in the hash
+func (vm *VM) executeHashIndex(hash, index object.Object) error {
+	hashObject := hash.(*object.Hash)
+
+	key, ok := index.(object.Hashable)
+	if !ok {
+		return newOperandError([]object.Object{hash, index}, "unusable value as hash key: %s", index.Type())
+	}
+
+	pair, ok := hashObject.Pairs[key.HashKey()]
+	if !ok {
+		return vm.push(object.NULL)
+	}
+
+	return vm.push(pair.Value)
+}
@@ -1,13 +1,21 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"lookageek.com/ode/ast"
+	"lookageek.com/ode/budget"
+	"lookageek.com/ode/code"
 	"lookageek.com/ode/compiler"
 	"lookageek.com/ode/lexer"
 	"lookageek.com/ode/object"
 	"lookageek.com/ode/parser"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 type vmTestCase struct {
@@ -34,28 +42,91 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testBooleanObject(expected bool, actual object.Object) error {
+	result, ok := actual.(*object.Boolean)
+	if !ok {
+		return fmt.Errorf("object is not Boolean. got = %T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got = %t, want = %t", result.Value, expected)
+	}
+
+	return nil
+}
+
+func testStringObject(expected string, actual object.Object) error {
+	result, ok := actual.(*object.String)
+	if !ok {
+		return fmt.Errorf("object is not String. got = %T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got = %q, want = %q", result.Value, expected)
+	}
+
+	return nil
+}
+
 func runVmTests(t *testing.T, tests []vmTestCase) {
 	t.Helper()
 
-	for _, tt := range tests {
-		program := parse(tt.input)
+	// every test runs on the optimized and on the unoptimized bytecode,
+	// the optimizer must not change what a program does
+	for _, optimize := range []bool{true, false} {
+		for _, tt := range tests {
+			program := parse(tt.input)
 
-		comp := compiler.New()
-		err := comp.Compile(program)
-		if err != nil {
-			t.Fatalf("compiler error: %s", err)
-		}
+			comp := compiler.New()
+			comp.SetOptimizations(optimize)
+			err := comp.Compile(program)
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
 
-		vm := New(comp.Bytecode())
-		err = vm.Run()
-		if err != nil {
-			t.Fatalf("vm error: %s", err)
+			// everything the compiler emits has to pass the verifier
+			bytecode := comp.Bytecode()
+			err = Verify(bytecode)
+			if err != nil {
+				t.Fatalf("%q (optimize = %t): verifier error: %s", tt.input, optimize, err)
+			}
+
+			vm := New(bytecode)
+			err = vm.Run()
+
+			// an expected error object means the execution has to fail with its message
+			if expectedErr, ok := tt.expected.(*object.Error); ok {
+				if err == nil {
+					t.Fatalf("%q (optimize = %t): expected VM error %q but resulted in none", tt.input, optimize, expectedErr.Message)
+				}
+
+				if message := runtimeErrorMessage(t, err); message != expectedErr.Message {
+					t.Fatalf("%q (optimize = %t): wrong VM error: want = %q, got = %q", tt.input, optimize, expectedErr.Message, message)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%q (optimize = %t): vm error: %s", tt.input, optimize, err)
+			}
+
+			stackElem := vm.LastPoppedStackElem()
+
+			testExpectedObject(t, tt.expected, stackElem)
 		}
+	}
+}
 
-		stackElem := vm.StackTop()
+// runtimeErrorMessage is the message of the *RuntimeError which Run returned
+func runtimeErrorMessage(t *testing.T, err error) string {
+	t.Helper()
 
-		testExpectedObject(t, tt.expected, stackElem)
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got = %T (%+v)", err, err)
 	}
+
+	return runtimeErr.Message
 }
 
 func testExpectedObject(t *testing.T, expected interface{}, actual object.Object) {
@@ -67,6 +138,66 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if err != nil {
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
+
+	case bool:
+		err := testBooleanObject(expected, actual)
+		if err != nil {
+			t.Errorf("testBooleanObject failed: %s", err)
+		}
+
+	case string:
+		err := testStringObject(expected, actual)
+		if err != nil {
+			t.Errorf("testStringObject failed: %s", err)
+		}
+
+	case []int:
+		array, ok := actual.(*object.Array)
+		if !ok {
+			t.Errorf("object not Array: %T (%+v)", actual, actual)
+			return
+		}
+
+		if len(array.Elements) != len(expected) {
+			t.Errorf("wrong num of elements. want = %d, got = %d", len(expected), len(array.Elements))
+			return
+		}
+
+		for i, expectedElem := range expected {
+			err := testIntegerObject(int64(expectedElem), array.Elements[i])
+			if err != nil {
+				t.Errorf("testIntegerObject failed: %s", err)
+			}
+		}
+
+	case map[object.HashKey]int64:
+		hash, ok := actual.(*object.Hash)
+		if !ok {
+			t.Errorf("object is not Hash. got = %T (%+v)", actual, actual)
+			return
+		}
+
+		if len(hash.Pairs) != len(expected) {
+			t.Errorf("hash has wrong number of Pairs. want = %d, got = %d", len(expected), len(hash.Pairs))
+			return
+		}
+
+		for expectedKey, expectedValue := range expected {
+			pair, ok := hash.Pairs[expectedKey]
+			if !ok {
+				t.Errorf("no pair for given key in Pairs")
+			}
+
+			err := testIntegerObject(expectedValue, pair.Value)
+			if err != nil {
+				t.Errorf("testIntegerObject failed: %s", err)
+			}
+		}
+
+	case *object.Null:
+		if actual != object.NULL {
+			t.Errorf("object is not Null: %T (%+v)", actual, actual)
+		}
 	}
 }
 
@@ -75,7 +206,1093 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"1", 1},
 		{"2", 2},
 		{"1 + 2", 3},
+		{"1 - 2", -1},
+		{"1 * 2", 2},
+		{"4 / 2", 2},
+		{"50 / 2 * 2 + 10 - 5", 55},
+		{"5 + 5 + 5 + 5 - 10", 10},
+		{"2 * 2 * 2 * 2 * 2", 32},
+		{"5 * 2 + 10", 20},
+		{"5 + 2 * 10", 25},
+		{"5 * (2 + 10)", 60},
+		{"-5", -5},
+		{"-10", -10},
+		{"-50 + 100 + -50", 0},
+		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBooleanExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"true", true},
+		{"false", false},
+		{"true == true", true},
+		{"false == false", true},
+		{"true == false", false},
+		{"true != false", true},
+		{"!true", false},
+		{"!false", true},
+		{"!5", false},
+		{"!!true", true},
+		{"!!false", false},
+		{"!!5", true},
+		{"!(if (false) { 5; })", true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestComparisonExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"1 < 2", true},
+		{"1 > 2", false},
+		{"1 < 1", false},
+		{"1 > 1", false},
+		{"1 == 1", true},
+		{"1 != 1", false},
+		{"1 == 2", false},
+		{"1 != 2", true},
+		{"(1 < 2) == (2 > 1)", true},
+		{"(1 < 2) != (1 > 2)", true},
+		{"(1 > 2) == (2 > 1)", false},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestComparisonEvaluationOrder(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"let f = fn(x) { puts(x); x }; f(1) < f(2)", true},
+		{"let f = fn(x) { puts(x); x }; f(1) > f(2)", false},
+	}
+
+	for _, tt := range tests {
+		// the left operand is evaluated first, like in the evaluator
+		vm := New(compile(t, tt.input))
+		output := captureOutput(t, func() {
+			err := vm.Run()
+			if err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+		})
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+
+		if output != "1\n2\n" {
+			t.Errorf("wrong order of the operands. want = %q, got = %q", "1\n2\n", output)
+		}
+	}
+}
+
+// captureOutput returns what run prints to the standard output, e.g. with puts
+func captureOutput(t *testing.T, run func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe error: %s", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	run()
+	w.Close()
+
+	output, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+
+	return string(output)
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []vmTestCase{
+		{"if (true) { 10 }", 10},
+		{"if (true) { 10 } else { 20 }", 10},
+		{"if (false) { 10 } else { 20 } ", 20},
+		{"if (1) { 10 }", 10},
+		{"if (1 < 2) { 10 }", 10},
+		{"if (1 < 2) { 10 } else { 20 }", 10},
+		{"if (1 > 2) { 10 } else { 20 }", 20},
+		{"if (1 > 2) { 10 }", object.NULL},
+		{"if (false) { 10 }", object.NULL},
+		{"if ((if (false) { 10 })) { 10 } else { 20 }", 20},
+		{"if (true) { }", object.NULL},
+		{"if (false) { 10 } else { }", object.NULL},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"let one = 1; one", 1},
+		{"let one = 1; let two = 2; one + two", 3},
+		{"let one = 1; let two = one + one; one + two", 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestGlobalsStoreIsShared(t *testing.T) {
+	var globals []object.Object
+	symbolTable := compiler.NewSymbolTable()
+	constants := []object.Object{}
+
+	for i, input := range []string{"let a = 5;", "let b = a * 2;", "a + b"} {
+		comp := compiler.NewWithState(symbolTable, constants)
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error in line %d: %s", i, err)
+		}
+
+		bytecode := comp.Bytecode()
+		constants = bytecode.Constants
+
+		vm := NewWithGlobalsStore(bytecode, globals)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error in line %d: %s", i, err)
+		}
+		globals = vm.Globals()
+
+		if i == 2 {
+			testExpectedObject(t, 15, vm.LastPoppedStackElem())
+		}
+	}
+}
+
+func TestStringExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`"ode"`, "ode"},
+		{`"o" + "de"`, "ode"},
+		{`"o" + "de" + "lang"`, "odelang"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestArrayLiterals(t *testing.T) {
+	tests := []vmTestCase{
+		{"[]", []int{}},
+		{"[1, 2, 3]", []int{1, 2, 3}},
+		{"[1 + 2, 3 * 4, 5 + 6]", []int{3, 12, 11}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHashLiterals(t *testing.T) {
+	tests := []vmTestCase{
+		{"{}", map[object.HashKey]int64{}},
+		{
+			"{1: 2, 2: 3}",
+			map[object.HashKey]int64{
+				(&object.Integer{Value: 1}).HashKey(): 2,
+				(&object.Integer{Value: 2}).HashKey(): 3,
+			},
+		},
+		{
+			"{1 + 1: 2 * 2, 3 + 3: 4 * 4}",
+			map[object.HashKey]int64{
+				(&object.Integer{Value: 2}).HashKey(): 4,
+				(&object.Integer{Value: 6}).HashKey(): 16,
+			},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIndexExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2, 3][1]", 2},
+		{"[1, 2, 3][0 + 2]", 3},
+		{"[[1, 1, 1]][0][0]", 1},
+		{"[][0]", object.NULL},
+		{"[1, 2, 3][99]", object.NULL},
+		{"[1][-1]", object.NULL},
+		{"{1: 1, 2: 2}[1]", 1},
+		{"{1: 1, 2: 2}[2]", 2},
+		{"{1: 1}[0]", object.NULL},
+		{"{}[0]", object.NULL},
+		{`{"one": 1}["one"]`, 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctionsWithoutArguments(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let fivePlusTen = fn() { 5 + 10; };
+			fivePlusTen();
+			`,
+			expected: 15,
+		},
+		{
+			input: `
+			let one = fn() { 1; };
+			let two = fn() { 2; };
+			one() + two()
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+			let a = fn() { 1 };
+			let b = fn() { a() + 1 };
+			let c = fn() { b() + 1 };
+			c();
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+			let earlyExit = fn() { return 99; 100; };
+			earlyExit();
+			`,
+			expected: 99,
+		},
+		{
+			input: `
+			let noReturn = fn() { };
+			noReturn();
+			`,
+			expected: object.NULL,
+		},
+		{
+			input: `
+			let returnsOne = fn() { 1; };
+			let returnsOneReturner = fn() { returnsOne; };
+			returnsOneReturner()();
+			`,
+			expected: 1,
+		},
 	}
 
 	runVmTests(t, tests)
 }
+
+func TestCallingFunctionsWithBindings(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let one = fn() { let one = 1; one };
+			one();
+			`,
+			expected: 1,
+		},
+		{
+			input: `
+			let oneAndTwo = fn() { let one = 1; let two = 2; one + two; };
+			let threeAndFour = fn() { let three = 3; let four = 4; three + four; };
+			oneAndTwo() + threeAndFour();
+			`,
+			expected: 10,
+		},
+		{
+			input: `
+			let globalSeed = 50;
+			let minusOne = fn() {
+				let num = 1;
+				globalSeed - num;
+			}
+			let minusTwo = fn() {
+				let num = 2;
+				globalSeed - num;
+			}
+			minusOne() + minusTwo();
+			`,
+			expected: 97,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctionsWithArgumentsAndBindings(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let identity = fn(a) { a; };
+			identity(4);
+			`,
+			expected: 4,
+		},
+		{
+			input: `
+			let sum = fn(a, b) { a + b; };
+			sum(1, 2);
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+			let sum = fn(a, b) {
+				let c = a + b;
+				c;
+			};
+			let outer = fn() {
+				sum(1, 2) + sum(3, 4);
+			};
+			outer();
+			`,
+			expected: 10,
+		},
+		{
+			input: `
+			let globalNum = 10;
+
+			let sum = fn(a, b) {
+				let c = a + b;
+				c + globalNum;
+			};
+
+			let outer = fn() {
+				sum(1, 2) + sum(3, 4) + globalNum;
+			};
+
+			outer() + globalNum;
+			`,
+			expected: 50,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctionsWithWrongArguments(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input:    `fn() { 1; }(1);`,
+			expected: `wrong number of arguments: want = 0, got = 1`,
+		},
+		{
+			input:    `fn(a) { a; }();`,
+			expected: `wrong number of arguments: want = 1, got = 0`,
+		},
+		{
+			input:    `fn(a, b) { a + b; }(1);`,
+			expected: `wrong number of arguments: want = 2, got = 1`,
+		},
+		{
+			input:    `1(2);`,
+			expected: `not a function: INTEGER`,
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if message := runtimeErrorMessage(t, err); message != tt.expected {
+			t.Fatalf("wrong VM error: want = %q, got = %q", tt.expected, message)
+		}
+	}
+}
+
+func TestTopLevelReturn(t *testing.T) {
+	tests := []vmTestCase{
+		{"return 10; 9;", 10},
+		{"9; return 2 * 5; 9;", 10},
+		{"if (10 > 1) { if (10 > 1) { return 10; } return 1; }", 10},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("")`, 0},
+		{`len("four")`, 4},
+		{`len("hello world")`, 11},
+		{
+			`len(1)`,
+			&object.Error{
+				Message: "argument to `len` not supported, got INTEGER",
+			},
+		},
+		{
+			`len("one", "two")`,
+			&object.Error{
+				Message: "wrong number of arguments. got = 2, want = 1",
+			},
+		},
+		{`len([1, 2, 3])`, 3},
+		{`len([])`, 0},
+		{`puts("hello", "world!")`, object.NULL},
+		{`first([1, 2, 3])`, 1},
+		{`first([])`, object.NULL},
+		{
+			`first(1)`,
+			&object.Error{
+				Message: "argument to `first` must be ARRAY, got INTEGER",
+			},
+		},
+		{`last([1, 2, 3])`, 3},
+		{`last([])`, object.NULL},
+		{
+			`last(1)`,
+			&object.Error{
+				Message: "argument to `last` must be ARRAY, got INTEGER",
+			},
+		},
+		{`rest([1, 2, 3])`, []int{2, 3}},
+		{`rest([])`, object.NULL},
+		{`push([], 1)`, []int{1}},
+		{
+			`push(1, 1)`,
+			&object.Error{
+				Message: "argument to `push` must be ARRAY, got INTEGER",
+			},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let newClosure = fn(a) {
+				fn() { a; };
+			};
+			let closure = newClosure(99);
+			closure();
+			`,
+			expected: 99,
+		},
+		{
+			input: `
+			let newAdder = fn(a, b) {
+				fn(c) { a + b + c };
+			};
+			let adder = newAdder(1, 2);
+			adder(8);
+			`,
+			expected: 11,
+		},
+		{
+			input: `
+			let newAdderOuter = fn(a, b) {
+				let c = a + b;
+				fn(d) {
+					let e = d + c;
+					fn(f) { e + f; };
+				};
+			};
+			let newAdderInner = newAdderOuter(1, 2)
+			let adder = newAdderInner(3);
+			adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+			let a = 1;
+			let newAdderOuter = fn(b) {
+				fn(c) {
+					fn(d) { a + b + c + d };
+				};
+			};
+			let newAdderInner = newAdderOuter(2)
+			let adder = newAdderInner(3);
+			adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+			let newClosure = fn(a, b) {
+				let one = fn() { a; };
+				let two = fn() { b; };
+				fn() { one() + two(); };
+			};
+			let closure = newClosure(9, 90);
+			closure();
+			`,
+			expected: 99,
+		},
+		{
+			input: `
+			let curry = fn(f) { fn(x) { fn(y) { f(x, y) } } };
+			let add = curry(fn(a, b) { a + b });
+			add(3)(4);
+			`,
+			expected: 7,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let countDown = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					countDown(x - 1);
+				}
+			};
+			countDown(1);
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+			let countDown = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					countDown(x - 1);
+				}
+			};
+			let wrapper = fn() {
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) {
+					if (x == 0) {
+						return 0;
+					} else {
+						countDown(x - 1);
+					}
+				};
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expected: 0,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFibonacci(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let fibonacci = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					if (x == 1) {
+						return 1;
+					} else {
+						fibonacci(x - 1) + fibonacci(x - 2);
+					}
+				}
+			};
+			fibonacci(15);
+			`,
+			expected: 610,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{"5 + true;", &object.Error{Message: "type mismatch: INTEGER + BOOLEAN"}},
+		{"5 + true; 5;", &object.Error{Message: "type mismatch: INTEGER + BOOLEAN"}},
+		{"-true", &object.Error{Message: "unknown operator: -BOOLEAN"}},
+		{"true + false;", &object.Error{Message: "unknown operator: BOOLEAN + BOOLEAN"}},
+		{"true > false;", &object.Error{Message: "unknown operator: BOOLEAN > BOOLEAN"}},
+		{"1 > true;", &object.Error{Message: "type mismatch: INTEGER > BOOLEAN"}},
+		{"1 < true;", &object.Error{Message: "type mismatch: INTEGER < BOOLEAN"}},
+		{`"a" < "b"`, &object.Error{Message: "unknown operator: STRING < STRING"}},
+		{`"Hello" - "World"`, &object.Error{Message: "unknown operator: STRING - STRING"}},
+		{`"a" == "a"`, &object.Error{Message: "unknown operator: STRING == STRING"}},
+		{"999[1]", &object.Error{Message: "index operator not supported: INTEGER"}},
+		{`{"name": "Ode"}[fn(x) { x }];`, &object.Error{Message: "unusable value as hash key: CLOSURE"}},
+		{"len(1); 5", &object.Error{Message: "argument to `len` not supported, got INTEGER"}},
+		{"1 / 0", &object.Error{Message: "division by zero"}},
+		{"let f = fn(x) { 10 / x }; f(0);", &object.Error{Message: "division by zero"}},
+		// the optimizer must not remove reading an unset variable whose value is not used
+		{"if (false) { let a = 1 }; a; 5", &object.Error{Message: "a is used before it is set"}},
+		{"let f = fn() { if (false) { let a = 1 }; a; 5 }; f()", &object.Error{Message: "a is used before it is set"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRuntimeErrorDetails(t *testing.T) {
+	tests := []struct {
+		input        string
+		opcode       code.Opcode
+		offset       int
+		operandTypes []object.ObjectType
+	}{
+		// 0000 OpConstant 0, 0003 OpTrue, 0004 OpAdd
+		{"1 + true", code.OpAdd, 4, []object.ObjectType{object.INTEGER_OBJ, object.BOOLEAN_OBJ}},
+		// 0000 OpTrue, 0001 OpMinus
+		{"-true", code.OpMinus, 1, []object.ObjectType{object.BOOLEAN_OBJ}},
+		// 0000 OpConstant 0, 0003 OpConstant 1, 0006 OpIndex
+		{"999[1]", code.OpIndex, 6, []object.ObjectType{object.INTEGER_OBJ, object.INTEGER_OBJ}},
+		// 0000 OpConstant 0, 0003 OpCall 0
+		{"5()", code.OpCall, 3, []object.ObjectType{object.INTEGER_OBJ}},
+		// 0000 OpConstant 0, 0003 OpConstant 1, 0006 OpDiv
+		{"1 / 0", code.OpDiv, 6, []object.ObjectType{}},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		if err == nil {
+			t.Fatalf("%q: expected VM error but resulted in none.", tt.input)
+		}
+
+		runtimeErr := err.(*RuntimeError)
+		if runtimeErr.Opcode != tt.opcode || runtimeErr.Offset != tt.offset {
+			t.Errorf("%q: wrong instruction. want = %d at %04d, got = %d at %04d",
+				tt.input, tt.opcode, tt.offset, runtimeErr.Opcode, runtimeErr.Offset)
+		}
+
+		if len(runtimeErr.OperandTypes) != len(tt.operandTypes) {
+			t.Errorf("%q: wrong operand types. want = %v, got = %v", tt.input, tt.operandTypes, runtimeErr.OperandTypes)
+			continue
+		}
+		for i, operandType := range tt.operandTypes {
+			if runtimeErr.OperandTypes[i] != operandType {
+				t.Errorf("%q: wrong operand types. want = %v, got = %v", tt.input, tt.operandTypes, runtimeErr.OperandTypes)
+			}
+		}
+	}
+}
+
+// TestMalformedBytecode runs instructions the compiler never emits,
+// the VM has to fail with an error instead of crashing
+func TestMalformedBytecode(t *testing.T) {
+	tests := []struct {
+		instructions code.Instructions
+		expected     string
+	}{
+		{
+			code.Instructions{255},
+			"opcode 255 at 0000: opcode 255 undefined",
+		},
+		{
+			code.Make(code.OpConstant, 1)[:2],
+			"OpConstant at 0000: instruction truncated",
+		},
+		{
+			code.Make(code.OpPop),
+			"OpPop at 0000: stack underflow: needs 1 values, has 0",
+		},
+		{
+			concatInstructions(code.Make(code.OpTrue), code.Make(code.OpAdd)),
+			"OpAdd at 0001: stack underflow: needs 2 values, has 1",
+		},
+		{
+			code.Make(code.OpCall, 0),
+			"OpCall at 0000: stack underflow: needs 1 values, has 0",
+		},
+		{
+			concatInstructions(code.Make(code.OpTrue), code.Make(code.OpHash, 1)),
+			"OpHash at 0001: hash of 1 elements, keys and values have to pair up",
+		},
+		{
+			code.Make(code.OpConstant, 7),
+			"OpConstant at 0000: constant 7 out of range, there are 0 constants",
+		},
+		{
+			code.Make(code.OpClosure, 7, 0),
+			"OpClosure at 0000: constant 7 out of range, there are 0 constants",
+		},
+		{
+			code.Make(code.OpGetLocal, 0),
+			"OpGetLocal at 0000: local 0 out of range, the function has 0 locals",
+		},
+		{
+			code.Make(code.OpGetGlobal, 3),
+			"OpGetGlobal at 0000: global 3 is used before it is set",
+		},
+		{
+			code.Make(code.OpGetBuiltin, 200),
+			fmt.Sprintf("OpGetBuiltin at 0000: builtin 200 out of range, there are %d builtins", len(object.Builtins)),
+		},
+		{
+			code.Make(code.OpGetFree, 0),
+			"OpGetFree at 0000: free variable 0 out of range, the closure has 0",
+		},
+	}
+
+	for _, tt := range tests {
+		err := New(&compiler.Bytecode{Instructions: tt.instructions}).Run()
+		if err == nil {
+			t.Errorf("%v: expected VM error but resulted in none.", tt.instructions)
+			continue
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want = %q, got = %q", tt.expected, err)
+		}
+	}
+}
+
+func TestReturnInMainProgram(t *testing.T) {
+	vm := New(&compiler.Bytecode{Instructions: concatInstructions(code.Make(code.OpTrue), code.Make(code.OpReturn))})
+	err := vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if vm.LastPoppedStackElem() != object.NULL {
+		t.Errorf("wrong result. want = object.NULL, got = %+v", vm.LastPoppedStackElem())
+	}
+}
+
+func concatInstructions(s ...code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range s {
+		out = append(out, ins...)
+	}
+
+	return out
+}
+
+func TestLetStatementsProduceNoValue(t *testing.T) {
+	program := parse("1; let a = 2;")
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if vm.LastPoppedStackElem() != nil {
+		t.Errorf("let statement left a value. got = %+v", vm.LastPoppedStackElem())
+	}
+}
+
+func TestRedefiningGlobals(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = 1; let f = fn() { a }; let a = 2; f()", 2},
+		{"let a = 1; let a = a + 1; a", 2},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestUnsetLocals(t *testing.T) {
+	tests := []string{
+		"let f = fn() { if (false) { let a = 1 }; a + 1 }; f()",
+		"let f = fn() { if (false) { let a = 1 }; puts(a) }; f()",
+		"let f = fn() { if (false) { let a = 1 }; [a][0] + 1 }; f()",
+		// g leaves its local in the stack slot f's local lives in
+		"let g = fn() { let b = 5; b }; let f = fn() { if (false) { let a = 1 }; a }; g(); f()",
+	}
+
+	for _, input := range tests {
+		err := New(compile(t, input)).Run()
+		if !errors.Is(err, ErrUnset) {
+			t.Errorf("%s: expected the local to be unset. got = %v", input, err)
+			continue
+		}
+
+		expected := "a is used before it is set"
+		if err.(*RuntimeError).Message != expected {
+			t.Errorf("wrong error. want = %q, got = %q", expected, err.(*RuntimeError).Message)
+		}
+	}
+}
+
+func TestWideConstants(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 70000; i++ {
+		fmt.Fprintf(&input, "%d;", i)
+	}
+	input.WriteString("69999 - 65536")
+
+	runVmTests(t, []vmTestCase{{input.String(), 4463}})
+}
+
+func TestWideClosures(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 70000; i++ {
+		fmt.Fprintf(&input, "%d;", i)
+	}
+	input.WriteString("let a = 3; let f = fn(b) { fn(c) { a + b + c } }; f(69999)(1)")
+
+	runVmTests(t, []vmTestCase{{input.String(), 70003}})
+}
+
+func TestRuntimeErrorLocations(t *testing.T) {
+	input := `let add = fn(a, b) {
+  a + b
+};
+let apply = fn(f) { let result = f(1, true); result };
+apply(add);`
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+	bytecode.File = "main.ode"
+
+	err = New(bytecode).Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	expected := "main.ode:2:5: type mismatch: INTEGER + BOOLEAN"
+	if err.Error() != expected {
+		t.Errorf("wrong error. want = %q, got = %q", expected, err)
+	}
+
+	expectedTrace := `	at add (main.ode:2:5)
+	at apply (main.ode:4:35)
+	at <main> (main.ode:5:6)
+`
+	if trace := err.(*RuntimeError).StackTrace(); trace != expectedTrace {
+		t.Errorf("wrong stack trace.\nwant = %q\ngot  = %q", expectedTrace, trace)
+	}
+}
+
+func TestStackTraceOfStackOverflow(t *testing.T) {
+	input := "let f = fn(x) { f(x) + 1 }; f(1);"
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = New(comp.Bytecode()).Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	runtimeErr := err.(*RuntimeError)
+	if len(runtimeErr.CallStack) != MaxFrames {
+		t.Errorf("wrong call stack depth. want = %d, got = %d", MaxFrames, len(runtimeErr.CallStack))
+	}
+
+	trace := runtimeErr.StackTrace()
+	if lines := strings.Count(trace, "\n"); lines != 2*maxTraceFrames+1 {
+		t.Errorf("stack trace is not cut short. got %d lines:\n%s", lines, trace)
+	}
+
+	elided := fmt.Sprintf("\t... %d more frames\n", MaxFrames-2*maxTraceFrames)
+	if !strings.Contains(trace, elided) {
+		t.Errorf("stack trace does not count the left out frames:\n%s", trace)
+	}
+}
+
+// endless runs for about 2^40 calls without nesting them deeper than 40
+const endless = "let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) + f(n - 1) } }; f(40);"
+
+func TestLimits(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		input    string
+		ctx      context.Context
+		limits   budget.Limits
+		expected error
+	}{
+		{"steps", endless, context.Background(), budget.Limits{Steps: 1000}, budget.ErrSteps},
+		{"depth", "let f = fn(x) { f(x) + 1 }; f(1);", context.Background(), budget.Limits{Depth: 100}, budget.ErrDepth},
+		{"time", endless, context.Background(), budget.Limits{Time: 10 * time.Millisecond}, budget.ErrTime},
+		{"canceled context", endless, canceled, budget.Limits{}, context.Canceled},
+		{"within the limits", "let f = fn(x) { x }; f(1) + f(2)", context.Background(), budget.Limits{Steps: 100, Depth: 1, Time: time.Minute}, nil},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("%s: compiler error: %s", tt.name, err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetLimits(tt.limits)
+		err = vm.RunContext(tt.ctx)
+
+		if tt.expected == nil {
+			if err != nil {
+				t.Errorf("%s: vm error: %s", tt.name, err)
+			}
+			continue
+		}
+
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s: wrong error. want = %s, got = %v", tt.name, tt.expected, err)
+			continue
+		}
+
+		if _, ok := err.(*RuntimeError); !ok {
+			t.Errorf("%s: the error is not a *RuntimeError. got = %T", tt.name, err)
+		}
+	}
+}
+
+func TestDepthLimitStackTrace(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let f = fn(x) { f(x) + 1 };\nf(1);"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.SetLimits(budget.Limits{Depth: 3})
+	err = vm.Run()
+
+	expected := "1:18: call depth limit exceeded: more than 3 nested calls"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("wrong error. want = %q, got = %v", expected, err)
+	}
+
+	if callStack := err.(*RuntimeError).CallStack; len(callStack) != 4 {
+		t.Errorf("wrong call stack depth. want = 4, got = %d", len(callStack))
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			// far deeper than MaxFrames and StackSize allow for nested calls
+			"let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + n) } }; loop(100000, 0);",
+			5000050000,
+		},
+		{
+			"let loop = fn(n) { if (n == 0) { return 0; } return loop(n - 1); }; loop(100000);",
+			0,
+		},
+		{
+			"let count = fn(n) { if (n == 0) { 0 } else { let m = n - 1; count(m) } }; count(100000);",
+			0,
+		},
+		{
+			// the called function has more locals than the caller
+			"let g = fn(a, b) { let c = a + b; let d = c * 2; d }; let f = fn(x) { g(x, 1) }; f(3);",
+			8,
+		},
+		{
+			// and fewer, the locals of the caller are not the ones of the called function
+			"let g = fn(a) { a }; let f = fn(x) { let y = x * 2; let z = y + 1; g(z) }; f(3);",
+			7,
+		},
+		{
+			"let f = fn(a) { len(a) }; f([1, 2]) + 1;",
+			3,
+		},
+		{
+			"let adder = fn(x) { fn(y) { x + y } }; let f = fn(x) { adder(x)(2) }; f(1);",
+			3,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTailCallStackTrace(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let g = fn() { 1 + true };\nlet f = fn() { g() };\nf();"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = New(comp.Bytecode()).Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	// f made a tail call so its frame is the frame of g
+	expected := "\tat g (1:18)\n\tat <main> (3:2)\n"
+	if trace := err.(*RuntimeError).StackTrace(); trace != expected {
+		t.Errorf("wrong stack trace.\nwant = %q\ngot  = %q", expected, trace)
+	}
+}
+
+func TestTailCallsDoNotNest(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let loop = fn(n) { if (n == 0) { 0 } else { loop(n - 1) } }; loop(10000);"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.SetLimits(budget.Limits{Depth: 1})
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+}
+
+// fibonacci is the workload of the benchmarks, its calls, comparisons
+// and additions push mostly small integers and booleans
+const fibonacci = `let fibonacci = fn(x) {
+	if (x < 2) { x } else { fibonacci(x - 1) + fibonacci(x - 2) }
+};
+fibonacci(20);`
+
+func BenchmarkFibonacci(b *testing.B) {
+	comp := compiler.New()
+	err := comp.Compile(parse(fibonacci))
+	if err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+
+	program, err := NewProgram(comp.Bytecode())
+	if err != nil {
+		b.Fatalf("program error: %s", err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vm := program.NewVM()
+		err := vm.Run()
+		if err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
+}